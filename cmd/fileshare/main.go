@@ -1,26 +1,33 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
-	"io"
+	"fmt"
 	"log"
-	"net"
+	"net/http"
 	"os"
-	"path/filepath"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/awgh/huzaa-bot/internal/acl"
+	"github.com/awgh/huzaa-bot/internal/bot"
 	"github.com/awgh/huzaa-bot/internal/config"
 	"github.com/awgh/huzaa-bot/internal/fileshare"
 	"github.com/awgh/huzaa-bot/internal/irc"
+	"github.com/awgh/huzaa-bot/internal/tlsutil"
 	"github.com/awgh/huzaa-bot/internal/turnclient"
 	ircgo "github.com/fluffle/goirc/client"
 )
 
+// transferMetrics publishes each network's transfer registry at /debug/vars.
+var transferMetrics = expvar.NewMap("transfers")
+
 func main() {
 	confDir := flag.String("confdir", "config", "Config directory with *.json")
 	debugFlag := flag.Bool("debug", false, "Enable debug logging for RESUME and download")
+	metricsAddr := flag.String("metrics", "", "Serve transfer metrics as JSON at /debug/vars on this address (e.g. localhost:9100)")
 	flag.Parse()
 	debug := *debugFlag
 	turnclient.Debug = debug
@@ -33,467 +40,238 @@ func main() {
 		log.Fatal("no valid fileshare configs found")
 	}
 
-	root, err := fileshare.ResolveRoot(configs[0].SharedDir)
+	if *metricsAddr != "" {
+		go func() {
+			log.Printf("metrics: %v", http.ListenAndServe(*metricsAddr, nil))
+		}()
+	}
+
+	// One independent bot per config. A network that fails to set up or panics while running is
+	// logged and does not stop the others; panics in the bot's command handlers and transfers are
+	// recovered by the bot itself, which keeps its network running.
+	var wg sync.WaitGroup
+	for _, cfg := range configs {
+		wg.Add(1)
+		go func(cfg *config.FileshareConfig) {
+			defer wg.Done()
+			logger := log.New(os.Stderr, "["+cfg.Network+"] ", log.LstdFlags)
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Printf("panic: %v", r)
+				}
+			}()
+			if err := runNetwork(cfg, logger, debug); err != nil {
+				logger.Printf("stopped: %v", err)
+			}
+		}(cfg)
+	}
+	wg.Wait()
+	log.Fatal("all networks stopped")
+}
+
+// runNetwork starts the IRC connection, relay client and shared root for one config and
+// keeps the connection alive. It only returns if the network cannot be set up.
+func runNetwork(cfg *config.FileshareConfig, logger *log.Logger, debug bool) error {
+	root, err := fileshare.ResolveRoot(cfg.SharedDir)
+	if err != nil {
+		return fmt.Errorf("shared dir: %w", err)
+	}
+
+	uploads, err := fileshare.NewUploads(root, cfg.UploadConflict)
+	if err != nil {
+		return err
+	}
+
+	settings, err := botSettings(cfg)
 	if err != nil {
-		log.Fatalf("shared dir: %v", err)
+		return err
 	}
 
-	relayClient, err := turnclient.NewClient(configs[0].RelayTURNURL, nil, configs[0].RelayAuthUsername, configs[0].RelayAuthSecret)
+	relayTLS, err := tlsutil.Config(&tlsutil.Options{
+		CAFile:       cfg.RelayCAFile,
+		Fingerprints: cfg.RelayFingerprints,
+		SPKIPins:     cfg.RelaySPKIPins,
+		CertFile:     cfg.RelayCertFile,
+		KeyFile:      cfg.RelayKeyFile,
+	})
 	if err != nil {
-		log.Fatalf("relay client: %v", err)
+		return fmt.Errorf("relay tls: %w", err)
+	}
+	selection, err := turnclient.ParseSelection(cfg.RelaySelection)
+	if err != nil {
+		return err
+	}
+	relayClient, err := turnclient.NewFailoverClient(cfg.RelayURLs(), relayTLS, cfg.RelayAuthUsername, cfg.RelayAuthSecret)
+	if err != nil {
+		return fmt.Errorf("relay client: %w", err)
+	}
+	relayClient.Selection = selection
+	relayClient.LegacyAuth = cfg.RelayLegacyAuth
+	relayClient.DialTimeout = seconds(cfg.RelayDialTimeout)
+	relayClient.AcceptTimeout = seconds(cfg.RelayAcceptTimeout)
+	relayClient.IdleTimeout = seconds(cfg.RelayIdleTimeout)
+	if len(cfg.RelayURLs()) > 1 && cfg.RelayHealthInterval >= 0 {
+		interval := seconds(cfg.RelayHealthInterval)
+		if interval == 0 {
+			interval = time.Minute
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go watchRelays(ctx, relayClient, interval, logger)
 	}
 
 	ircCfg := &irc.Config{
-		Host:         configs[0].Host,
-		Port:         configs[0].Port,
-		Nick:         configs[0].Nick,
-		Password:     configs[0].Password,
-		Channel:      configs[0].Channel,
-		Name:         configs[0].Name,
-		Version:      configs[0].Version,
-		Quit:         configs[0].Quit,
-		ProxyEnabled: configs[0].ProxyEnabled,
-		Proxy:        configs[0].Proxy,
-		SASL:         configs[0].SASL,
+		Host:           cfg.Host,
+		Port:           cfg.Port,
+		Nick:           cfg.Nick,
+		Password:       cfg.Password,
+		Channel:        cfg.Channel,
+		Name:           cfg.Name,
+		Version:        cfg.Version,
+		Quit:           cfg.Quit,
+		ProxyEnabled:   cfg.ProxyEnabled,
+		Proxy:          cfg.Proxy,
+		SASL:           cfg.SASL,
+		SASLMechanism:  cfg.SASLMechanism,
+		SASLAccount:    cfg.SASLAccount,
+		SASLPassword:   cfg.SASLPassword,
+		ClientCertFile: cfg.ClientCertFile,
+		ClientKeyFile:  cfg.ClientKeyFile,
+		Plaintext:      cfg.Plaintext,
+		TLSSkipVerify:  cfg.TLSSkipVerify,
+		TLSCAFile:      cfg.TLSCAFile,
+		TLSFingerprint: cfg.TLSFingerprint,
+		AccountTag:     settings.ACL.NeedsAccount(),
 	}
-	maxUpload := configs[0].MaxUploadBytes
-	maxFile := configs[0].MaxFileBytes
-	if maxFile == 0 {
-		maxFile = 100 * 1024 * 1024 // 100MB
+	conn, err := irc.Connect(ircCfg)
+	if err != nil {
+		return fmt.Errorf("irc: %w", err)
 	}
+	irc.JoinChannel(conn, cfg.Channel)
 
-	// dccHost resolves host to dotted-decimal IP for DCC CTCP; many clients only recognize numeric IPs.
-	dccHost := func(host string) string {
-		ips, err := net.LookupIP(host)
-		if err != nil {
-			return host
-		}
-		for _, ip := range ips {
-			if ip4 := ip.To4(); ip4 != nil {
-				return ip4.String()
-			}
+	// A rejected SASL login stops this network instead of running unauthenticated or retrying forever.
+	saslFailed := make(chan string, 1)
+	irc.OnSASLFailure(conn, func(reason string) {
+		select {
+		case saslFailed <- reason:
+		default:
 		}
-		return host
-	}
+		conn.Quit("SASL authentication failed")
+	})
 
-	conn := irc.Connect(ircCfg)
-	irc.JoinChannel(conn, configs[0].Channel)
+	out := irc.NewOutput(conn, &irc.OutputConfig{Rate: cfg.SendRate, Burst: cfg.SendBurst})
+	defer out.Close()
 
-	conn.HandleFunc(ircgo.PRIVMSG, func(c *ircgo.Conn, line *ircgo.Line) {
-		msg := line.Args[1]
-		replyTo := line.Nick
-		isChannel := line.Public()
-		send := func(m string) {
-			if isChannel {
-				c.Notice(configs[0].Channel, m)
-			} else {
-				c.Privmsg(replyTo, m)
-			}
-		}
+	b := bot.New(&bot.Config{
+		Root:           root,
+		Channel:        cfg.Channel,
+		Relay:          bot.NewRelay(relayClient),
+		Sender:         out,
+		MaxFileBytes:   cfg.MaxFileBytes,
+		MaxUploadBytes: cfg.MaxUploadBytes,
+		Logger:         logger,
+		Debug:          debug,
+		Uploads:        uploads,
+		UserQuotaBytes: cfg.UserQuotaBytes,
+		MinFreeBytes:   cfg.MinFreeBytes,
+		ACL:            settings.ACL,
+		Bans:           cfg.Bans,
 
-		// Commands only in private message for now; channel handling reserved for later.
-		if isChannel {
-			return
-		}
+		MaxTransfers:        cfg.MaxTransfers,
+		MaxTransfersPerUser: cfg.MaxTransfersPerUser,
+		MaxQueuedPerUser:    cfg.MaxQueuedPerUser,
 
-		if cmd, rest, ok := irc.ParseCTCP(msg); ok && irc.IsDCCSSEND(cmd, rest) {
-			filename, _, port, ok := irc.ParseDCCSSEND(rest)
-			if !ok {
-				send("Invalid DCC SSEND.")
-				return
-			}
-			_ = filename
-			_ = port
-			send("To upload, use .upload first; I'll give you the relay address.")
-			return
-		}
+		BandwidthBytes:         cfg.BandwidthBytes,
+		UserBandwidthBytes:     cfg.UserBandwidthBytes,
+		TransferBandwidthBytes: cfg.TransferBandwidthBytes,
 
-		// DCC RESUME: client wants to resume a download from a byte position.
-		// Use DCCResumeRestFromMessage so we recognize RESUME with or without CTCP \x01 delimiters.
-		if rest, ok := irc.DCCResumeRestFromMessage(msg); ok {
-			if debug {
-				log.Printf("[debug] PRIVMSG RESUME rest=%q", rest)
-			}
-			resumeFilename, _, position, ok := irc.ParseDCCResume(rest)
-			if !ok {
-				return
-			}
-			if debug {
-				log.Printf("[debug] RESUME parsed filename=%q position=%d replyTo=%s", resumeFilename, position, replyTo)
-			}
-			safePath, err := fileshare.SafePath(root, resumeFilename)
-			if err != nil {
-				send("Invalid path.")
-				return
-			}
-			f, err := os.Open(safePath)
+		// Connection, relay and shared directory settings need a restart; .reload picks up the rest.
+		Reload: func() (*bot.Settings, error) {
+			c, err := config.LoadFileshareConfig(cfg.Path)
 			if err != nil {
-				send("File not found.")
-				return
+				return nil, err
 			}
-			info, err := f.Stat()
-			f.Close()
-			if err != nil || info.IsDir() {
-				send("Not a file.")
-				return
-			}
-			size := info.Size()
-			if position < 0 || position >= size {
-				send("Resume position invalid.")
-				return
-			}
-			sessionID, err := turnclient.GenerateSessionID()
-			if err != nil {
-				send("Error creating session.")
-				return
-			}
-			_, port, sess, err := relayClient.RegisterDownload(sessionID, filepath.Base(resumeFilename))
-			if err != nil {
-				send("Relay error: " + err.Error())
-				return
-			}
-			if debug {
-				acceptLine := "\x01DCC ACCEPT " + filepath.Base(resumeFilename) + " " + strconv.Itoa(port) + " " + strconv.FormatInt(position, 10) + "\x01"
-				log.Printf("[debug] sending ACCEPT (NOTICE): %q", acceptLine)
-			}
-			// CTCP replies (e.g. DCC ACCEPT) must be sent as NOTICE so the client recognizes them.
-			c.CtcpReply(replyTo, "DCC ACCEPT", filepath.Base(resumeFilename), strconv.Itoa(port), strconv.FormatInt(position, 10))
-			go func() {
-				f2, _ := os.Open(safePath)
-				if f2 == nil {
-					return
-				}
-				defer f2.Close()
-				defer sess.Close()
-				if _, err := f2.Seek(position, io.SeekStart); err != nil {
-					log.Printf("resume seek: %v", err)
-					return
-				}
-				remaining := size - position
-				if maxFile > 0 && remaining > maxFile {
-					remaining = maxFile
-				}
-				if err := sess.SendFile(f2, remaining); err != nil {
-					log.Printf("resume send: %v", err)
-				}
-			}()
-			send("Resume accepted; connect in your client to continue from byte " + strconv.FormatInt(position, 10) + ".")
-			return
-		}
+			return botSettings(c)
+		},
+	})
+	b.Attach(conn)
+	transferMetrics.Set(cfg.Network, expvar.Func(func() any { return b.Transfers().Metrics() }))
 
-		parts := strings.Fields(msg)
-		if len(parts) == 0 {
-			return
-		}
-		switch parts[0] {
-		case ".list", ".ls":
-			pattern := ""
-			if len(parts) > 1 {
-				pattern = parts[1]
-			}
-			entries, err := fileshare.ListDir(root, pattern)
-			if err != nil {
-				send("List error: " + err.Error())
-				return
-			}
-			if len(entries) == 0 {
-				send("No files.")
-				return
-			}
-			var names []string
-			for _, e := range entries {
-				names = append(names, e.Name())
-			}
-			send(strings.Join(names, ", "))
-		case ".download", ".get":
-			if len(parts) < 2 {
-				send("Usage: .download <filename>")
-				return
-			}
-			filename := parts[1]
-			safePath, err := fileshare.SafePath(root, filename)
-			if err != nil {
-				send("Invalid path.")
-				return
-			}
-			f, err := os.Open(safePath)
-			if err != nil {
-				send("File not found.")
-				return
-			}
-			info, _ := f.Stat()
-			if info.IsDir() {
-				f.Close()
-				send("Not a file.")
-				return
-			}
-			size := info.Size()
-			if size == 0 {
-				f.Close()
-				send("File is empty; cannot send.")
-				return
-			}
-			if maxFile > 0 && size > maxFile {
-				f.Close()
-				send("File too large.")
-				return
-			}
-			sessionID, err := turnclient.GenerateSessionID()
-			if err != nil {
-				f.Close()
-				send("Error creating session.")
-				return
-			}
-			host, port, sess, err := relayClient.RegisterDownload(sessionID, filepath.Base(filename))
-			if err != nil {
-				f.Close()
-				send("Relay error: " + err.Error())
-				return
-			}
-			ctcpMsg := "\x01DCC SSEND " + filepath.Base(filename) + " " + dccHost(host) + " " + strconv.Itoa(port) + " " + strconv.FormatInt(size, 10) + "\x01"
-			c.Privmsg(replyTo, ctcpMsg)
-			go func() {
-				defer f.Close()
-				defer sess.Close()
-				if err := sess.SendFile(f, maxFile); err != nil {
-					log.Printf("send file: %v", err)
-				}
-			}()
-			send("Accept in your client to download from relay.")
-		case ".upload", ".put":
-			sessionID, err := turnclient.GenerateSessionID()
-			if err != nil {
-				send("Error creating session.")
-				return
-			}
-			filename := ""
-			if len(parts) > 1 {
-				filename = parts[1]
-			}
-			filename = filepath.Base(filename)
-			if filename == "" || filename == "." {
-				filename = "upload-" + time.Now().Format("20060102-150405")
-			}
-			host, port, stream, err := relayClient.RegisterUploadStream(sessionID, filename)
-			if err != nil {
-				send("Relay error: " + err.Error())
-				return
-			}
-			safePath, err := fileshare.SafePath(root, filename)
-			if err != nil {
-				stream.Close()
-				send("Invalid filename.")
-				return
-			}
-			go func() {
-				defer stream.Close()
-				var r io.Reader = stream
-				if maxUpload > 0 {
-					r = io.LimitReader(stream, maxUpload)
-				}
-				// Don't create the file until we receive at least one byte (avoids empty "upload" from failed/abandoned transfers).
-				buf := make([]byte, 1)
-				n, err := r.Read(buf)
-				if err != nil || n == 0 {
-					return // no data received, create nothing
-				}
-				f, err := os.Create(safePath)
-				if err != nil {
-					log.Printf("upload create: %v", err)
-					return
-				}
-				_, _ = f.Write(buf[:n])
-				_, err = io.Copy(f, r)
-				f.Close()
-				if err != nil {
-					log.Printf("upload write: %v", err)
-				}
-			}()
-			// DCC SRECV = we (bot) want to RECEIVE; client connects and SENDS. SSEND would mean we send (wrong direction).
-			// Format: DCC SRECV <filename> <ip> <port> <resume_pos>. Resume 0 for new transfer.
-			ctcpUpload := "\x01DCC SRECV " + filename + " " + dccHost(host) + " " + strconv.Itoa(port) + " 0\x01"
-			c.Privmsg(replyTo, ctcpUpload)
-			send("Accept the DCC above to upload as " + filename + " (your client will send the file).")
-		case ".help":
-			send(".list [pattern] | .download <file> | .put / .upload [filename]  (PM only)")
-		default:
-			// ignore
-		}
+	conn.HandleFunc(ircgo.DISCONNECTED, func(c *ircgo.Conn, l *ircgo.Line) {
+		logger.Println("Disconnected")
 	})
 
-	// DCC RESUME arrives as CTCP, not PRIVMSG (goirc parses \x01...\x01 and dispatches as CTCP).
-	// Line.Args = ["DCC", target, "RESUME filename port position"].
-	conn.HandleFunc(ircgo.CTCP, func(c *ircgo.Conn, line *ircgo.Line) {
-		if line.Public() {
-			return
-		}
-		if len(line.Args) < 3 || line.Args[0] != "DCC" || !strings.HasPrefix(strings.ToUpper(line.Args[2]), "RESUME ") {
-			return
+	for {
+		if !conn.Connected() {
+			logger.Println("Connecting...")
+			if err := conn.Connect(); err != nil {
+				logger.Println("Connect:", err)
+			}
 		}
-		rest := line.Args[2]
-		replyTo := line.Nick
-		send := func(m string) { c.Privmsg(replyTo, m) }
-		if debug {
-			log.Printf("[debug] CTCP from %s Args=%q", line.Nick, line.Args)
+		select {
+		case reason := <-saslFailed:
+			conn.Close()
+			return fmt.Errorf("SASL authentication failed: %s", reason)
+		case <-time.After(15 * time.Second):
 		}
+	}
+}
 
-		resumeFilename, _, position, ok := irc.ParseDCCResume(rest)
-		if !ok {
-			return
-		}
-		if debug {
-			log.Printf("[debug] RESUME parsed filename=%q position=%d replyTo=%s", resumeFilename, position, replyTo)
-		}
-		safePath, err := fileshare.SafePath(root, resumeFilename)
-		if err != nil {
-			send("Invalid path.")
-			return
-		}
-		f, err := os.Open(safePath)
-		if err != nil {
-			send("File not found.")
-			return
-		}
-		info, err := f.Stat()
-		f.Close()
-		if err != nil || info.IsDir() {
-			send("Not a file.")
-			return
-		}
-		size := info.Size()
-		if position < 0 || position >= size {
-			send("Resume position invalid.")
-			return
-		}
-		sessionID, err := turnclient.GenerateSessionID()
-		if err != nil {
-			send("Error creating session.")
-			return
-		}
-		_, port, sess, err := relayClient.RegisterDownload(sessionID, filepath.Base(resumeFilename))
-		if err != nil {
-			send("Relay error: " + err.Error())
-			return
-		}
-		if debug {
-			acceptLine := "\x01DCC ACCEPT " + filepath.Base(resumeFilename) + " " + strconv.Itoa(port) + " " + strconv.FormatInt(position, 10) + "\x01"
-			log.Printf("[debug] sending ACCEPT (NOTICE): %q", acceptLine)
-		}
-		// CTCP replies (e.g. DCC ACCEPT) must be sent as NOTICE so the client recognizes them.
-		c.CtcpReply(replyTo, "DCC ACCEPT", filepath.Base(resumeFilename), strconv.Itoa(port), strconv.FormatInt(position, 10))
-		go func() {
-			f2, _ := os.Open(safePath)
-			if f2 == nil {
-				return
-			}
-			defer f2.Close()
-			defer sess.Close()
-			if _, err := f2.Seek(position, io.SeekStart); err != nil {
-				log.Printf("resume seek: %v", err)
+// watchRelays checks the relays every interval, logging when one goes down or comes back, until
+// ctx is cancelled.
+func watchRelays(ctx context.Context, c *turnclient.Client, interval time.Duration, logger *log.Logger) {
+	healthy := make(map[string]bool)
+	for _, h := range c.Health() {
+		healthy[h.URL] = true
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, h := range c.CheckHealth(ctx) {
+			if ctx.Err() != nil {
 				return
 			}
-			remaining := size - position
-			if maxFile > 0 && remaining > maxFile {
-				remaining = maxFile
-			}
-			if err := sess.SendFile(f2, remaining); err != nil {
-				log.Printf("resume send: %v", err)
+			switch {
+			case healthy[h.URL] && !h.Healthy:
+				logger.Printf("relay %s is down: %v", h.URL, h.Err)
+			case !healthy[h.URL] && h.Healthy:
+				logger.Printf("relay %s is back", h.URL)
 			}
-		}()
-		send("Resume accepted; connect in your client to continue from byte " + strconv.FormatInt(position, 10) + ".")
-	})
-
-	// DCC RESUME can also arrive as CTCPREPLY if the client sent it as NOTICE.
-	conn.HandleFunc(ircgo.CTCPREPLY, func(c *ircgo.Conn, line *ircgo.Line) {
-		if line.Public() {
-			return
+			healthy[h.URL] = h.Healthy
 		}
-		if len(line.Args) < 3 || line.Args[0] != "DCC" || !strings.HasPrefix(strings.ToUpper(line.Args[2]), "RESUME ") {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
 		}
-		rest := line.Args[2]
-		replyTo := line.Nick
-		send := func(m string) { c.Privmsg(replyTo, m) }
-		if debug {
-			log.Printf("[debug] CTCPREPLY from %s Args=%q", line.Nick, line.Args)
-		}
+	}
+}
 
-		resumeFilename, _, position, ok := irc.ParseDCCResume(rest)
-		if !ok {
-			return
-		}
-		if debug {
-			log.Printf("[debug] RESUME parsed filename=%q position=%d replyTo=%s", resumeFilename, position, replyTo)
-		}
-		safePath, err := fileshare.SafePath(root, resumeFilename)
-		if err != nil {
-			send("Invalid path.")
-			return
-		}
-		f, err := os.Open(safePath)
-		if err != nil {
-			send("File not found.")
-			return
-		}
-		info, err := f.Stat()
-		f.Close()
-		if err != nil || info.IsDir() {
-			send("Not a file.")
-			return
-		}
-		size := info.Size()
-		if position < 0 || position >= size {
-			send("Resume position invalid.")
-			return
-		}
-		sessionID, err := turnclient.GenerateSessionID()
-		if err != nil {
-			send("Error creating session.")
-			return
-		}
-		_, port, sess, err := relayClient.RegisterDownload(sessionID, filepath.Base(resumeFilename))
-		if err != nil {
-			send("Relay error: " + err.Error())
-			return
-		}
-		if debug {
-			acceptLine := "\x01DCC ACCEPT " + filepath.Base(resumeFilename) + " " + strconv.Itoa(port) + " " + strconv.FormatInt(position, 10) + "\x01"
-			log.Printf("[debug] sending ACCEPT (NOTICE): %q", acceptLine)
-		}
-		c.CtcpReply(replyTo, "DCC ACCEPT", filepath.Base(resumeFilename), strconv.Itoa(port), strconv.FormatInt(position, 10))
-		go func() {
-			f2, _ := os.Open(safePath)
-			if f2 == nil {
-				return
-			}
-			defer f2.Close()
-			defer sess.Close()
-			if _, err := f2.Seek(position, io.SeekStart); err != nil {
-				log.Printf("resume seek: %v", err)
-				return
-			}
-			remaining := size - position
-			if maxFile > 0 && remaining > maxFile {
-				remaining = maxFile
-			}
-			if err := sess.SendFile(f2, remaining); err != nil {
-				log.Printf("resume send: %v", err)
-			}
-		}()
-		send("Resume accepted; connect in your client to continue from byte " + strconv.FormatInt(position, 10) + ".")
-	})
+// botSettings returns the bot settings in cfg that can change at runtime.
+func botSettings(cfg *config.FileshareConfig) (*bot.Settings, error) {
+	access, err := acl.New(cfg.ACL)
+	if err != nil {
+		return nil, err
+	}
+	return &bot.Settings{
+		MaxFileBytes:   cfg.MaxFileBytes,
+		MaxUploadBytes: cfg.MaxUploadBytes,
+		UserQuotaBytes: cfg.UserQuotaBytes,
+		MinFreeBytes:   cfg.MinFreeBytes,
+		ACL:            access,
+		Bans:           cfg.Bans,
 
-	conn.HandleFunc(ircgo.DISCONNECTED, func(c *ircgo.Conn, l *ircgo.Line) {
-		log.Println("Disconnected")
-	})
+		MaxTransfers:        cfg.MaxTransfers,
+		MaxTransfersPerUser: cfg.MaxTransfersPerUser,
+		MaxQueuedPerUser:    cfg.MaxQueuedPerUser,
 
-	for {
-		if !conn.Connected() {
-			log.Println("Connecting...")
-			if err := conn.Connect(); err != nil {
-				log.Println("Connect:", err)
-			}
-		}
-		time.Sleep(15 * time.Second)
-	}
+		BandwidthBytes:         cfg.BandwidthBytes,
+		UserBandwidthBytes:     cfg.UserBandwidthBytes,
+		TransferBandwidthBytes: cfg.TransferBandwidthBytes,
+	}, nil
+}
+
+// seconds converts a config value in seconds to a Duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
 }
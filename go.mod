@@ -4,10 +4,12 @@ go 1.23.0
 
 toolchain go1.24.4
 
-require github.com/fluffle/goirc v1.3.4
+require (
+	github.com/emersion/go-sasl v0.0.0-20220912192320-0145f2c60ead
+	github.com/fluffle/goirc v1.3.4
+)
 
 require (
-	github.com/emersion/go-sasl v0.0.0-20220912192320-0145f2c60ead // indirect
 	github.com/golang/mock v1.5.0 // indirect
 	golang.org/x/net v0.43.0 // indirect
 )
@@ -52,11 +52,12 @@ fi
 mkdir -p "$BOT_HOME/config" "$BOT_HOME/shared"
 cp -f fileshare_bin "$BOT_HOME/fileshare"
 
-echo "=== 4. Bot config (IRC localhost + relay URL) ==="
+echo "=== 4. Bot config (plaintext IRC on localhost + relay URL) ==="
 cat > "$BOT_HOME/config/${CONFIG_NAME}.json" << EOF
 {
   "Host": "127.0.0.1",
-  "Port": "6697",
+  "Port": "6667",
+  "Plaintext": true,
   "Nick": "HuzaaBot",
   "Password": "HuzaaBot:REPLACE_WITH_BOT_PASSWORD",
   "Channel": "#files",
@@ -0,0 +1,199 @@
+// Package acl decides which IRC users may list, download, upload or administer which parts of the
+// shared root. Rules match users by hostmask, services account and status in the bot's channel.
+package acl
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Permissions a rule can grant. Admin implies all others.
+const (
+	List     = "list"
+	Download = "download"
+	Upload   = "upload"
+	Admin    = "admin"
+)
+
+// Channel status levels a rule can require. Each level includes the ones above it (op has voice).
+const (
+	Member = "member"
+	Voice  = "voice"
+	Op     = "op"
+)
+
+// Rule grants permissions to the users it matches. All criteria that are set must match.
+type Rule struct {
+	// Hostmask is a nick!ident@host glob (* and ?, case-insensitive). Empty matches everyone.
+	Hostmask string `json:"Hostmask,omitempty"`
+	// Account is the services account, case-insensitive; "*" matches any logged-in user.
+	Account string `json:"Account,omitempty"`
+	// Channel is the status required in the bot's channel: member, voice or op.
+	Channel string `json:"Channel,omitempty"`
+	// Path limits the rule to a directory under the shared root (slash-separated); empty is the whole root.
+	Path string `json:"Path,omitempty"`
+	// Allow lists the permissions granted: list, download, upload, admin.
+	Allow []string `json:"Allow"`
+}
+
+// User is who is asking, as far as the bot knows.
+type User struct {
+	Nick, Ident, Host string
+	Account           string // "" if not logged in or unknown
+	// Status in the bot's channel.
+	Member, Voice, Op bool
+}
+
+// Hostmask returns nick!ident@host.
+func (u *User) Hostmask() string {
+	return u.Nick + "!" + u.Ident + "@" + u.Host
+}
+
+// ACL is an ordered set of rules. A nil ACL, or one without rules, lets everyone list, download and
+// upload everywhere and nobody administer.
+type ACL struct {
+	rules []Rule
+}
+
+// New validates rules and returns an ACL.
+func New(rules []Rule) (*ACL, error) {
+	a := &ACL{}
+	for i, r := range rules {
+		for _, p := range r.Allow {
+			switch p {
+			case List, Download, Upload, Admin:
+			default:
+				return nil, fmt.Errorf("acl rule %d: unknown permission %q", i+1, p)
+			}
+		}
+		switch r.Channel {
+		case "", Member, Voice, Op:
+		default:
+			return nil, fmt.Errorf("acl rule %d: unknown channel status %q", i+1, r.Channel)
+		}
+		r.Path = cleanPath(r.Path)
+		a.rules = append(a.rules, r)
+	}
+	return a, nil
+}
+
+// NeedsAccount reports whether any rule matches on services account, so the bot has to find out
+// users' accounts.
+func (a *ACL) NeedsAccount() bool {
+	if a == nil {
+		return false
+	}
+	for _, r := range a.rules {
+		if r.Account != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether u has perm on the file or directory at p (slash-separated, relative to the
+// shared root; "" is the root).
+func (a *ACL) Allowed(u *User, perm, p string) bool {
+	if a == nil || len(a.rules) == 0 {
+		return perm != Admin
+	}
+	p = cleanPath(p)
+	for _, r := range a.rules {
+		if r.grants(perm) && covers(r.Path, p) && r.matches(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// Visible reports whether p should appear in u's listings: u may list p itself, or p is a directory
+// on the way to somewhere u may list.
+func (a *ACL) Visible(u *User, p string) bool {
+	if a.Allowed(u, List, p) {
+		return true
+	}
+	p = cleanPath(p)
+	for _, r := range a.rules {
+		if r.grants(List) && covers(p, r.Path) && r.matches(u) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) grants(perm string) bool {
+	for _, p := range r.Allow {
+		if p == perm || p == Admin {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matches(u *User) bool {
+	if r.Hostmask != "" && !Match(r.Hostmask, u.Hostmask()) {
+		return false
+	}
+	if r.Account != "" {
+		if u.Account == "" || (r.Account != "*" && !strings.EqualFold(r.Account, u.Account)) {
+			return false
+		}
+	}
+	switch r.Channel {
+	case Member:
+		return u.Member || u.Voice || u.Op
+	case Voice:
+		return u.Voice || u.Op
+	case Op:
+		return u.Op
+	}
+	return true
+}
+
+// covers reports whether dir is p or one of its parents.
+func covers(dir, p string) bool {
+	return dir == "" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// cleanPath returns p as a clean slash-separated path relative to the root ("" for the root). ".."
+// cannot climb above the root.
+func cleanPath(p string) string {
+	p = path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+	if p == "/" {
+		return ""
+	}
+	return strings.TrimPrefix(p, "/")
+}
+
+// Match reports whether s matches the IRC-style glob pattern (* any run, ? one character), ignoring case.
+func Match(pattern, s string) bool {
+	return match(strings.ToLower(pattern), strings.ToLower(s))
+}
+
+// match is a greedy glob matcher: on a mismatch it retries from the last '*', letting it take one
+// more byte. Earlier stars never need revisiting, so it runs in O(len(pattern)·len(s)) however many
+// stars the pattern has.
+func match(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0 // position of the last '*' in pattern, and where in s it started matching
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case star >= 0:
+			mark++
+			p, i = star+1, mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,126 @@
+package acl
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*!*@*.example.org", "alice!a@host.example.org", true},
+		{"*!*@*.example.org", "alice!a@example.org", false},
+		{"Alice!*@*", "alice!a@h", true},
+		{"al?ce!*", "alice!a@h", true},
+		{"al?ce!*", "alce!a@h", false},
+		{"*", "", true},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"*a*b", "aab", true},
+		{"a*", "", false},
+		{"*?", "", false},
+		{"**x", "x", true},
+		{"*ab", "aaab", true},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v", tt.pattern, tt.s, got)
+		}
+	}
+}
+
+func TestMatchManyStars(t *testing.T) {
+	// Each '*' used to multiply the work by the length of the hostmask, which the sender chooses.
+	s := strings.Repeat("a", 60) + "!x@h"
+	start := time.Now()
+	if Match("*a*a*a*a*a*a*b", s) {
+		t.Error("matched without a b")
+	}
+	if !Match("*a*a*a*a*a*a*h", s) {
+		t.Error("no match")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("took %v", d)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	a, err := New([]Rule{
+		{Hostmask: "*!*@staff.example.org", Allow: []string{Admin}},
+		{Account: "*", Allow: []string{List, Download}},
+		{Account: "uploader", Allow: []string{Upload}},
+		{Channel: Member, Path: "public", Allow: []string{List, Download}},
+		{Channel: Op, Path: "incoming", Allow: []string{Upload}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staff := &User{Nick: "boss", Ident: "b", Host: "staff.example.org"}
+	anon := &User{Nick: "anon", Ident: "a", Host: "x"}
+	member := &User{Nick: "m", Ident: "m", Host: "x", Member: true}
+	op := &User{Nick: "o", Ident: "o", Host: "x", Op: true}
+	loggedIn := &User{Nick: "l", Ident: "l", Host: "x", Account: "Someone"}
+	uploader := &User{Nick: "u", Ident: "u", Host: "x", Account: "Uploader"}
+
+	tests := []struct {
+		name string
+		user *User
+		perm string
+		path string
+		want bool
+	}{
+		{"admin has everything", staff, Upload, "any/where", true},
+		{"admin", staff, Admin, "", true},
+		{"anonymous", anon, List, "", false},
+		{"any account lists", loggedIn, List, "docs", true},
+		{"any account cannot upload", loggedIn, Upload, "", false},
+		{"named account uploads", uploader, Upload, "", true},
+		{"member in public", member, Download, "public/a.txt", true},
+		{"member outside public", member, Download, "private/a.txt", false},
+		{"member path prefix is not a parent", member, Download, "publicity/a.txt", false},
+		{"member cannot escape with ..", member, Download, "public/../private/a.txt", false},
+		{"op is a member", op, List, "public", true},
+		{"op uploads to incoming", op, Upload, "incoming/x", true},
+		{"member cannot upload to incoming", member, Upload, "incoming/x", false},
+		{"nobody else administers", uploader, Admin, "", false},
+	}
+	for _, tt := range tests {
+		if got := a.Allowed(tt.user, tt.perm, tt.path); got != tt.want {
+			t.Errorf("%s: Allowed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if !a.Visible(member, "") || a.Visible(member, "private") || !a.Visible(member, "public/x") {
+		t.Error("member should see the root and public/, not private/")
+	}
+	if !a.NeedsAccount() {
+		t.Error("NeedsAccount = false")
+	}
+}
+
+func TestNoRules(t *testing.T) {
+	var nilACL *ACL
+	empty, _ := New(nil)
+	u := &User{Nick: "anyone"}
+	for _, a := range []*ACL{nilACL, empty} {
+		if !a.Allowed(u, List, "") || !a.Allowed(u, Download, "x") || !a.Allowed(u, Upload, "") || a.Allowed(u, Admin, "") {
+			t.Error("default permissions wrong")
+		}
+		if a.NeedsAccount() {
+			t.Error("NeedsAccount without rules")
+		}
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, r := range []Rule{
+		{Allow: []string{"delete"}},
+		{Channel: "founder", Allow: []string{List}},
+	} {
+		if _, err := New([]Rule{r}); err == nil {
+			t.Errorf("New(%+v) succeeded", r)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package bot
+
+import (
+	"strings"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/acl"
+)
+
+// run runs fn for m's command once the sender's account is known, unless they are banned.
+func (b *Bot) run(m *Message, fn func()) {
+	b.identify(m, func() {
+		if !b.banned(m) {
+			fn()
+		}
+	})
+}
+
+// whoisTimeout is how long commands wait for a WHOIS reply before running without an account.
+const whoisTimeout = 15 * time.Second
+
+// whoisRound is one outstanding WHOIS and the commands waiting for it.
+type whoisRound struct {
+	waiting []func(account string)
+	timer   *time.Timer
+}
+
+// identify runs fn once m.Account is known. When the ACL matches on accounts and the server did not
+// tag the message with one, the bot asks with WHOIS and runs fn when the reply ends, or without an
+// account if it does not come within whoisTimeout.
+func (b *Bot) identify(m *Message, fn func()) {
+	if m.accountKnown || b.whois == nil || !b.settings().ACL.NeedsAccount() {
+		fn()
+		return
+	}
+	key := strings.ToLower(m.Nick)
+	b.mu.Lock()
+	r := b.whoisWait[key]
+	first := r == nil
+	if first {
+		r = &whoisRound{}
+		r.timer = time.AfterFunc(b.whoisTimeout, func() { b.whoisDone(key, r) })
+		b.whoisWait[key] = r
+	}
+	r.waiting = append(r.waiting, func(account string) {
+		m.Account, m.accountKnown = account, true
+		fn()
+	})
+	b.mu.Unlock()
+	if first {
+		b.whois(m.Nick)
+	}
+}
+
+// whoisAccount records nick's account from RPL_WHOISACCOUNT.
+func (b *Bot) whoisAccount(nick, account string) {
+	b.mu.Lock()
+	b.whoisAcct[strings.ToLower(nick)] = account
+	b.mu.Unlock()
+}
+
+// whoisEnd runs the commands that were waiting for nick's WHOIS, on RPL_ENDOFWHOIS or
+// ERR_NOSUCHNICK.
+func (b *Bot) whoisEnd(nick string) {
+	key := strings.ToLower(nick)
+	b.mu.Lock()
+	r := b.whoisWait[key]
+	b.mu.Unlock()
+	b.whoisDone(key, r)
+}
+
+// whoisDone ends round r for key, if it is still the current one, and runs its commands with the
+// account seen so far ("" if none).
+func (b *Bot) whoisDone(key string, r *whoisRound) {
+	defer b.guard("commands waiting for WHOIS of "+key, nil)
+	b.mu.Lock()
+	if r == nil || b.whoisWait[key] != r {
+		b.mu.Unlock()
+		return
+	}
+	r.timer.Stop()
+	account := b.whoisAcct[key]
+	delete(b.whoisWait, key)
+	delete(b.whoisAcct, key)
+	b.mu.Unlock()
+	for _, fn := range r.waiting {
+		fn(account)
+	}
+}
+
+// whoisReset drops every outstanding WHOIS and the commands waiting for it, when the connection
+// is lost and the replies cannot come.
+func (b *Bot) whoisReset() {
+	b.mu.Lock()
+	for key, r := range b.whoisWait {
+		r.timer.Stop()
+		delete(b.whoisWait, key)
+	}
+	clear(b.whoisAcct)
+	b.mu.Unlock()
+}
+
+// user returns what the ACL needs to know about m's sender.
+func (b *Bot) user(m *Message) *acl.User {
+	u := &acl.User{Nick: m.Nick, Ident: m.Ident, Host: m.Host, Account: m.Account}
+	if b.channelStatus != nil {
+		u.Member, u.Voice, u.Op = b.channelStatus(m.Nick)
+	}
+	return u
+}
+
+// allowed reports whether m's sender has perm on p (relative to the root); if not, it tells them.
+func (b *Bot) allowed(m *Message, perm, p string) bool {
+	if b.settings().ACL.Allowed(b.user(m), perm, p) {
+		return true
+	}
+	b.reply(m, "Permission denied.")
+	return false
+}
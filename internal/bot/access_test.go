@@ -0,0 +1,133 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/acl"
+)
+
+func newACL(t *testing.T, rules ...acl.Rule) *acl.ACL {
+	t.Helper()
+	a, err := acl.New(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestACL(t *testing.T) {
+	relay := &fakeRelay{uploadData: "data"}
+	b, out, root := newTestBot(t, relay)
+	os.MkdirAll(filepath.Join(root, "public"), 0755)
+	os.MkdirAll(filepath.Join(root, "private"), 0755)
+	writeFile(t, filepath.Join(root, "public", "a.txt"), "a")
+	writeFile(t, filepath.Join(root, "private", "b.txt"), "b")
+	access := newACL(t,
+		acl.Rule{Path: "public", Allow: []string{acl.List, acl.Download}},
+		acl.Rule{Channel: acl.Voice, Allow: []string{acl.List, acl.Download, acl.Upload}},
+	)
+	set(b, func(s *Settings) { s.ACL = access })
+	voiced := map[string]bool{"bob": true}
+	b.channelStatus = func(nick string) (bool, bool, bool) { return voiced[nick], voiced[nick], false }
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".list"})
+	if got := listed(out.all()); got != "public/" {
+		t.Errorf("alice lists %q", got)
+	}
+	for _, cmd := range []string{".list private/", ".download private/b.txt", ".upload c.txt"} {
+		out.lines = nil
+		b.HandleMessage(&Message{Nick: "alice", Text: cmd})
+		if !out.contains("PRIVMSG alice :Permission denied.") {
+			t.Errorf("%s: got %q", cmd, out.all())
+		}
+	}
+	if len(relay.names) != 0 {
+		t.Errorf("sessions registered for denied commands: %q", relay.names)
+	}
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download public/a.txt"})
+	b.Wait()
+	if len(relay.downloads) != 1 {
+		t.Errorf("alice could not download public/a.txt: %q", out.all())
+	}
+
+	b.HandleMessage(&Message{Nick: "bob", Text: ".upload c.txt"})
+	b.Wait()
+	if _, err := os.Stat(filepath.Join(root, "c.txt")); err != nil {
+		t.Errorf("voiced upload: %v", err)
+	}
+}
+
+func TestACLAccount(t *testing.T) {
+	b, out, root := newTestBot(t, &fakeRelay{})
+	writeFile(t, filepath.Join(root, "a.txt"), "a")
+	access := newACL(t, acl.Rule{Account: "alice", Allow: []string{acl.List}})
+	set(b, func(s *Settings) { s.ACL = access })
+	var whois []string
+	b.whois = func(nick string) { whois = append(whois, nick) }
+
+	// Without an account tag the bot asks WHOIS and answers when it ends.
+	b.HandleMessage(&Message{Nick: "Alice", Text: ".list"})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".list"})
+	if len(whois) != 1 || len(out.all()) != 0 {
+		t.Fatalf("whois %q, replies %q", whois, out.all())
+	}
+	b.whoisAccount("alice", "ALICE")
+	b.whoisEnd("Alice")
+	if !out.contains("PRIVMSG Alice :a.txt") || !out.contains("PRIVMSG alice :a.txt") {
+		t.Errorf("got %q", out.all())
+	}
+
+	// Someone not logged in is refused; a tagged message needs no WHOIS.
+	out.lines = nil
+	b.HandleMessage(&Message{Nick: "mallory", Text: ".list"})
+	b.whoisEnd("mallory")
+	b.HandleMessage(&Message{Nick: "bob", Text: ".list", Account: "bob", accountKnown: true})
+	if !out.contains("PRIVMSG mallory :Permission denied.") || !out.contains("PRIVMSG bob :Permission denied.") || len(whois) != 2 {
+		t.Errorf("got %q, whois %q", out.all(), whois)
+	}
+}
+
+func TestWhoisNoReply(t *testing.T) {
+	b, out, _ := newTestBot(t, &fakeRelay{})
+	set(b, func(s *Settings) { s.ACL = newACL(t, acl.Rule{Account: "alice", Allow: []string{acl.List}}) })
+	var mu sync.Mutex
+	whois := 0
+	b.whois = func(string) { mu.Lock(); whois++; mu.Unlock() }
+	b.whoisTimeout = 20 * time.Millisecond
+
+	// Without a reply the commands run without an account once the timeout passes.
+	for i := 0; i < 3; i++ {
+		b.HandleMessage(&Message{Nick: "alice", Text: ".help"})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(out.all()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	b.mu.Lock()
+	waiting := len(b.whoisWait)
+	b.mu.Unlock()
+	if len(out.all()) != 3 || waiting != 0 {
+		t.Fatalf("replies %q, %d waiting", out.all(), waiting)
+	}
+	// The next command asks again.
+	b.HandleMessage(&Message{Nick: "alice", Text: ".help"})
+	b.whoisEnd("alice") // e.g. ERR_NOSUCHNICK
+	mu.Lock()
+	n := whois
+	mu.Unlock()
+	if n != 2 || len(out.all()) != 4 {
+		t.Errorf("whois %d, replies %q", n, out.all())
+	}
+
+	// A lost connection drops the waiting commands.
+	b.HandleMessage(&Message{Nick: "bob", Text: ".help"})
+	b.whoisReset()
+	b.whoisEnd("bob")
+	if len(b.whoisWait) != 0 || len(out.all()) != 4 {
+		t.Errorf("after reset: %d waiting, replies %q", len(b.whoisWait), out.all())
+	}
+}
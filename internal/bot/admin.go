@@ -0,0 +1,246 @@
+package bot
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/acl"
+	"github.com/awgh/huzaa-bot/internal/fileshare"
+	"github.com/awgh/huzaa-bot/internal/transfer"
+)
+
+// describe formats t for admins: "#1a2b3c4d upload of a.txt by alice" (by the owner if they quit).
+func describe(t *transfer.Transfer) string {
+	who := t.Nick()
+	if who == "" {
+		who = t.Owner
+	}
+	return "#" + t.Short() + " " + string(t.Direction) + " of " + t.File + " by " + who
+}
+
+// ban adds mask (nick!ident@host glob, or a bare nick) to the runtime ban list; it returns false
+// if it was already banned there or in the configuration.
+func (b *Bot) ban(mask string) bool {
+	mask = banMask(mask)
+	if configBanned(b.settings(), mask) {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range b.bans {
+		if strings.EqualFold(m, mask) {
+			return false
+		}
+	}
+	b.bans = append(b.bans, mask)
+	return true
+}
+
+// unban removes mask from the runtime ban list; it returns false if it was not there. Bans from
+// the configuration stay until it no longer lists them.
+func (b *Bot) unban(mask string) bool {
+	mask = banMask(mask)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, m := range b.bans {
+		if strings.EqualFold(m, mask) {
+			b.bans = append(b.bans[:i], b.bans[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// configBanned reports whether mask is one of the configured bans in s.
+func configBanned(s *Settings, mask string) bool {
+	for _, m := range s.Bans {
+		if strings.EqualFold(m, mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// banMask turns a bare nick into nick!*@*.
+func banMask(mask string) string {
+	if !strings.ContainsAny(mask, "!@") {
+		return mask + "!*@*"
+	}
+	return mask
+}
+
+// banned reports whether m's sender matches a ban. Admins are never banned, so a broad mask cannot
+// lock them out.
+func (b *Bot) banned(m *Message) bool {
+	u := b.user(m)
+	s := b.settings()
+	b.mu.Lock()
+	masks := append(append([]string(nil), s.Bans...), b.bans...)
+	b.mu.Unlock()
+	hit := false
+	for _, mask := range masks {
+		if acl.Match(mask, u.Hostmask()) {
+			hit = true
+			break
+		}
+	}
+	return hit && !s.ACL.Allowed(u, acl.Admin, "")
+}
+
+const adminHelp = "Admin: .transfers | .kill <id> | .ban [mask] | .unban <mask> | .reload | .bandwidth [global|user|transfer <rate>] | .say <target> <text> | .join/.part <channel> | .stats"
+
+// cmdAdmin runs an admin command; the caller has checked the admin permission.
+func (b *Bot) cmdAdmin(m *Message, cmd string, args []string) {
+	switch cmd {
+	case ".transfers":
+		list := b.transfers.List()
+		b.mu.Lock()
+		var queued []string
+		for i, j := range b.queue {
+			queued = append(queued, "queued #"+strconv.Itoa(i+1)+" "+j.what+" by "+j.m.Nick+", waiting "+time.Since(j.added).Round(time.Second).String())
+		}
+		b.mu.Unlock()
+		if len(list) == 0 && len(queued) == 0 {
+			b.reply(m, "No transfers.")
+		}
+		for _, t := range list {
+			b.reply(m, describe(t)+": "+string(t.State())+", "+fileshare.FormatSize(t.Bytes())+" in "+t.Elapsed().Round(time.Second).String())
+		}
+		for _, l := range queued {
+			b.reply(m, l)
+		}
+	case ".kill":
+		if len(args) != 1 {
+			b.reply(m, "Usage: .kill <id>")
+			return
+		}
+		t, err := b.transfers.Get(strings.TrimPrefix(args[0], "#"))
+		if err != nil {
+			b.reply(m, "Transfer "+args[0]+" is ambiguous; give more of its id.")
+			return
+		}
+		if t == nil {
+			b.reply(m, "No transfer "+args[0]+".")
+			return
+		}
+		if err := t.Cancel(); err != nil {
+			b.reply(m, "Kill "+describe(t)+": "+err.Error())
+			return
+		}
+		b.reply(m, "Killed "+describe(t)+".")
+	case ".ban":
+		if len(args) == 0 {
+			b.mu.Lock()
+			bans := strings.Join(b.bans, " ")
+			b.mu.Unlock()
+			if bans == "" {
+				bans = "none"
+			}
+			if cfg := b.settings().Bans; len(cfg) > 0 {
+				bans += "; from the config: " + strings.Join(cfg, " ")
+			}
+			b.reply(m, "Bans: "+bans)
+			return
+		}
+		if b.ban(args[0]) {
+			b.reply(m, "Banned "+banMask(args[0])+".")
+		} else {
+			b.reply(m, banMask(args[0])+" is already banned.")
+		}
+	case ".unban":
+		if len(args) != 1 {
+			b.reply(m, "Usage: .unban <mask>")
+			return
+		}
+		if b.unban(args[0]) {
+			b.reply(m, "Unbanned "+banMask(args[0])+".")
+		} else if configBanned(b.settings(), banMask(args[0])) {
+			b.reply(m, banMask(args[0])+" is banned in the config; remove it there and .reload.")
+		} else {
+			b.reply(m, banMask(args[0])+" is not banned.")
+		}
+	case ".reload":
+		if b.reload == nil {
+			b.reply(m, "Reload is not available.")
+			return
+		}
+		s, err := b.reload()
+		if err != nil {
+			b.reply(m, "Reload failed: "+err.Error())
+			return
+		}
+		b.Apply(s)
+		b.logger.Printf("settings reloaded by %s", m.Nick)
+		b.reply(m, "Reloaded.")
+	case ".bandwidth":
+		b.cmdBandwidth(m, args)
+	case ".say":
+		if len(args) < 2 {
+			b.reply(m, "Usage: .say <target> <text>")
+			return
+		}
+		b.out.Privmsg(args[0], strings.Join(args[1:], " "))
+	case ".join", ".part":
+		fn := b.join
+		if cmd == ".part" {
+			fn = b.part
+		}
+		if len(args) != 1 {
+			b.reply(m, "Usage: "+cmd+" <channel>")
+			return
+		}
+		if fn == nil {
+			b.reply(m, "Not connected.")
+			return
+		}
+		fn(args[0])
+	case ".stats":
+		tot := b.transfers.Totals()
+		b.reply(m, "Up "+time.Since(b.started).Round(time.Second).String()+"; "+strconv.Itoa(len(b.transfers.List()))+" running transfers; "+
+			strconv.Itoa(tot.Downloads)+" downloads and "+strconv.Itoa(tot.Uploads)+" uploads completed, "+strconv.Itoa(tot.Failed)+" failed, "+
+			strconv.Itoa(tot.Cancelled)+" killed; "+fileshare.FormatSize(tot.BytesSent)+" sent, "+fileshare.FormatSize(tot.BytesReceived)+" received.")
+	}
+}
+
+// cmdBandwidth shows the bandwidth limits, or with "global|user|transfer <rate>" changes one until
+// the next .reload. Running transfers slow down or speed up at once.
+func (b *Bot) cmdBandwidth(m *Message, args []string) {
+	cur := *b.settings()
+	if len(args) == 0 {
+		b.reply(m, "Bandwidth: "+rate(cur.BandwidthBytes)+" in total, "+rate(cur.UserBandwidthBytes)+" per user, "+rate(cur.TransferBandwidthBytes)+" per transfer.")
+		return
+	}
+	usage := "Usage: .bandwidth [global|user|transfer <bytes per second, e.g. 512K; 0 for unlimited>]"
+	if len(args) != 2 {
+		b.reply(m, usage)
+		return
+	}
+	n, err := fileshare.ParseSize(args[1])
+	if err != nil {
+		b.reply(m, usage)
+		return
+	}
+	switch args[0] {
+	case "global":
+		cur.BandwidthBytes = n
+	case "user":
+		cur.UserBandwidthBytes = n
+	case "transfer":
+		cur.TransferBandwidthBytes = n
+	default:
+		b.reply(m, usage)
+		return
+	}
+	b.Apply(&cur)
+	b.logger.Printf("%s bandwidth set to %s by %s", args[0], rate(n), m.Nick)
+	b.reply(m, "The "+args[0]+" bandwidth limit is now "+rate(n)+".")
+}
+
+// rate formats a bandwidth limit in bytes per second.
+func rate(n int64) string {
+	if n <= 0 {
+		return "unlimited"
+	}
+	return fileshare.FormatSize(n) + "/s"
+}
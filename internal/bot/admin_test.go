@@ -0,0 +1,147 @@
+package bot
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/acl"
+)
+
+// newAdminBot returns a test bot where root is an admin.
+func newAdminBot(t *testing.T, relay *fakeRelay) (*Bot, *fakeSender) {
+	t.Helper()
+	b, out, _ := newTestBot(t, relay)
+	access := newACL(t,
+		acl.Rule{Hostmask: "root!*@*", Allow: []string{acl.Admin}},
+		acl.Rule{Allow: []string{acl.List, acl.Download, acl.Upload}},
+	)
+	set(b, func(s *Settings) { s.ACL = access })
+	return b, out
+}
+
+func admin(b *Bot, text string) {
+	b.HandleMessage(&Message{Nick: "root", Ident: "r", Host: "h", Text: text})
+}
+
+func TestAdminDenied(t *testing.T) {
+	b, out, _ := newTestBot(t, &fakeRelay{})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".stats"})
+	if !out.contains("PRIVMSG alice :Permission denied.") {
+		t.Errorf("got %q", out.all())
+	}
+	b.HandleMessage(&Message{Nick: "alice", Text: ".help"})
+	if out.contains(adminHelp) {
+		t.Error("admin help shown to a non-admin")
+	}
+}
+
+func TestAdminTransfers(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	b, out := newAdminBot(t, &fakeRelay{uploadStream: pr})
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload a.txt"})
+	list := b.Transfers().List()
+	if len(list) != 1 {
+		t.Fatalf("%d transfers registered", len(list))
+	}
+	id := list[0].Short()
+	pw.Write([]byte("abc"))
+	for deadline := time.Now().Add(5 * time.Second); list[0].Bytes() < 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	admin(b, ".transfers")
+	if !out.contains("PRIVMSG root :#" + id + " upload of a.txt by alice: active, 3 B in ") {
+		t.Fatalf("got %q", out.all())
+	}
+	admin(b, ".kill nosuch")
+	admin(b, ".kill #"+id[:4])
+	b.Wait()
+	if !out.contains("PRIVMSG root :No transfer nosuch.") || !out.contains("PRIVMSG root :Killed #"+id+" upload of a.txt by alice.") {
+		t.Errorf("got %q", out.all())
+	}
+	out.lines = nil
+	admin(b, ".transfers")
+	admin(b, ".stats")
+	if !out.contains("PRIVMSG root :No transfers.") || !out.contains("0 running transfers; 0 downloads and 0 uploads completed, 0 failed, 1 killed; 0 B sent, 3 B received.") {
+		t.Errorf("got %q", out.all())
+	}
+}
+
+func TestAdminBan(t *testing.T) {
+	b, out := newAdminBot(t, &fakeRelay{})
+	admin(b, ".ban alice")
+	b.HandleMessage(&Message{Nick: "alice", Ident: "a", Host: "h", Text: ".list"})
+	if out.contains("PRIVMSG alice") {
+		t.Errorf("banned user got %q", out.all())
+	}
+	// A mask matching everyone does not lock out admins.
+	admin(b, ".ban *!*@*")
+	admin(b, ".ban")
+	if !out.contains("PRIVMSG root :Bans: alice!*@* *!*@*") {
+		t.Errorf("got %q", out.all())
+	}
+	admin(b, ".unban *!*@*")
+	admin(b, ".unban alice")
+	admin(b, ".unban bob")
+	b.HandleMessage(&Message{Nick: "alice", Ident: "a", Host: "h", Text: ".list"})
+	if !out.contains("PRIVMSG root :bob!*@* is not banned.") || !out.contains("PRIVMSG alice :No files.") {
+		t.Errorf("got %q", out.all())
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	b, out := newAdminBot(t, &fakeRelay{})
+	admin(b, ".reload")
+	if !out.contains("PRIVMSG root :Reload is not available.") {
+		t.Errorf("got %q", out.all())
+	}
+	next := *b.settings()
+	next.MaxUploadBytes = 5
+	next.Bans = []string{"mallory!*@*"}
+	b.reload = func() (*Settings, error) { return &next, nil }
+	admin(b, ".reload")
+	if !out.contains("PRIVMSG root :Reloaded.") || b.settings().MaxUploadBytes != 5 || !b.banned(&Message{Nick: "mallory"}) {
+		t.Errorf("got %q, settings %+v", out.all(), b.settings())
+	}
+	admin(b, ".unban mallory")
+	admin(b, ".ban eve")
+	admin(b, ".ban")
+	if !out.contains("PRIVMSG root :mallory!*@* is banned in the config; remove it there and .reload.") ||
+		!out.contains("PRIVMSG root :Bans: eve!*@*; from the config: mallory!*@*") {
+		t.Errorf("got %q", out.all())
+	}
+	// A reload that drops a config ban lifts it, but keeps bans made with .ban.
+	next.Bans = nil
+	admin(b, ".reload")
+	if b.banned(&Message{Nick: "mallory"}) || !b.banned(&Message{Nick: "eve"}) {
+		t.Error("config ban not replaced on reload")
+	}
+	b.reload = func() (*Settings, error) { return nil, errors.New("bad json") }
+	admin(b, ".reload")
+	if !out.contains("PRIVMSG root :Reload failed: bad json") || b.settings().MaxUploadBytes != 5 {
+		t.Errorf("got %q", out.all())
+	}
+}
+
+func TestAdminSayJoinPart(t *testing.T) {
+	b, out := newAdminBot(t, &fakeRelay{})
+	admin(b, ".join #other")
+	if !out.contains("PRIVMSG root :Not connected.") {
+		t.Errorf("got %q", out.all())
+	}
+	var joined, parted []string
+	b.join = func(ch string) { joined = append(joined, ch) }
+	b.part = func(ch string) { parted = append(parted, ch) }
+	admin(b, ".join #other")
+	admin(b, ".part #files")
+	admin(b, ".say #other hello   there")
+	if len(joined) != 1 || joined[0] != "#other" || len(parted) != 1 || parted[0] != "#files" {
+		t.Errorf("joined %q, parted %q", joined, parted)
+	}
+	if !out.contains("PRIVMSG #other :hello there") {
+		t.Errorf("got %q", out.all())
+	}
+}
@@ -0,0 +1,500 @@
+// Package bot implements the fileshare commands (list, download, upload, DCC RESUME) independently of
+// the IRC connection and relay, so every command path can be exercised without a live network.
+package bot
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/acl"
+	"github.com/awgh/huzaa-bot/internal/fileshare"
+	"github.com/awgh/huzaa-bot/internal/irc"
+	"github.com/awgh/huzaa-bot/internal/ratelimit"
+	"github.com/awgh/huzaa-bot/internal/transfer"
+	"github.com/awgh/huzaa-bot/internal/turnclient"
+	ircgo "github.com/fluffle/goirc/client"
+)
+
+// DefaultMaxFileBytes is the download size limit used when Config.MaxFileBytes is 0.
+const DefaultMaxFileBytes = 100 * 1024 * 1024 // 100MB
+
+// Sender is the part of the IRC connection the bot replies through. *irc.Output (paced, split to
+// the line limit) and *ircgo.Conn implement it.
+type Sender interface {
+	Privmsg(t, msg string)
+	Notice(t, msg string)
+	CtcpReply(t, ctcp string, arg ...string)
+}
+
+// DownloadSession streams one file to the relay. *turnclient.DownloadSession implements it.
+type DownloadSession interface {
+	SendFile(content io.Reader, maxBytes int64) error
+	SetLimiters(lims ...*ratelimit.Limiter)
+	Close() error
+}
+
+// UploadStream reads one upload from the relay. *turnclient.UploadStream implements it.
+type UploadStream interface {
+	io.ReadCloser
+	SetLimiters(lims ...*ratelimit.Limiter)
+}
+
+// Relay registers transfer sessions on the relay. Use NewRelay to wrap a *turnclient.Client.
+type Relay interface {
+	RegisterDownload(sessionID, filename string) (host string, port int, sess DownloadSession, err error)
+	RegisterUploadStream(sessionID, filename string) (host string, port int, stream UploadStream, err error)
+}
+
+// NewRelay adapts a turnclient.Client to the Relay interface.
+func NewRelay(c *turnclient.Client) Relay {
+	return relayClient{c}
+}
+
+type relayClient struct {
+	c *turnclient.Client
+}
+
+func (r relayClient) RegisterDownload(sessionID, filename string) (string, int, DownloadSession, error) {
+	host, port, sess, err := r.c.RegisterDownload(sessionID, filename)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return host, port, sess, nil
+}
+
+func (r relayClient) RegisterUploadStream(sessionID, filename string) (string, int, UploadStream, error) {
+	host, port, stream, err := r.c.RegisterUploadStream(sessionID, filename)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return host, port, stream, nil
+}
+
+// Config holds what a Bot needs for one network.
+type Config struct {
+	Root           string // absolute shared root (see fileshare.ResolveRoot)
+	Channel        string
+	Relay          Relay
+	Sender         Sender
+	MaxFileBytes   int64 // 0 means DefaultMaxFileBytes
+	MaxUploadBytes int64 // 0 means unlimited
+	Logger         *log.Logger
+	Debug          bool
+	// DCCHost maps the relay host to the address advertised in DCC lines. Defaults to resolving it
+	// to a dotted-decimal IPv4 address.
+	DCCHost func(host string) string
+	// Uploads places finished uploads under Root; nil means fileshare.ConflictReject.
+	Uploads *fileshare.Uploads
+	// UserQuotaBytes caps the total size of each user's uploads (0: no quota). MinFreeBytes is the
+	// free space uploads must leave on the shared filesystem (0: no floor).
+	UserQuotaBytes int64
+	MinFreeBytes   int64
+	// FreeSpace reports free bytes under a path; defaults to fileshare.FreeSpace.
+	FreeSpace func(path string) (int64, error)
+	// ACL decides who may list, download, upload and administer; nil lets everyone do everything
+	// but administer.
+	ACL *acl.ACL
+	// Bans are nick!ident@host masks whose commands are ignored.
+	Bans []string
+	// MaxTransfers, MaxTransfersPerUser and MaxQueuedPerUser: see Settings.
+	MaxTransfers        int
+	MaxTransfersPerUser int
+	MaxQueuedPerUser    int
+	// BandwidthBytes, UserBandwidthBytes and TransferBandwidthBytes: see Settings.
+	BandwidthBytes         int64
+	UserBandwidthBytes     int64
+	TransferBandwidthBytes int64
+	// Reload re-reads the configuration for .reload; nil disables it.
+	Reload func() (*Settings, error)
+}
+
+// Settings are the parts of a Bot's configuration that .reload can replace while it runs.
+type Settings struct {
+	MaxFileBytes   int64 // 0 means DefaultMaxFileBytes
+	MaxUploadBytes int64 // 0 means unlimited
+	UserQuotaBytes int64
+	MinFreeBytes   int64
+	ACL            *acl.ACL
+	// Bans are nick!ident@host masks whose commands are ignored, on top of the bans made with .ban.
+	// Each Apply replaces them; .ban and .unban do not change them.
+	Bans []string
+	// MaxTransfers and MaxTransfersPerUser limit running transfers (0: unlimited); requests over
+	// the limit wait in a queue. MaxQueuedPerUser caps each user's queued requests (0: unlimited).
+	MaxTransfers        int
+	MaxTransfersPerUser int
+	MaxQueuedPerUser    int
+	// BandwidthBytes caps the bytes per second of all transfers together, UserBandwidthBytes those
+	// of each user's transfers and TransferBandwidthBytes each transfer's (0: unlimited).
+	BandwidthBytes         int64
+	UserBandwidthBytes     int64
+	TransferBandwidthBytes int64
+}
+
+// Bot handles fileshare commands for one IRC network.
+type Bot struct {
+	root      string
+	channel   string
+	relay     Relay
+	out       Sender
+	uploads   *fileshare.Uploads
+	freeSpace func(string) (int64, error)
+	reload    func() (*Settings, error)
+	logger    *log.Logger
+	debug     bool
+	dccHost   func(string) string
+	started   time.Time
+
+	cur atomic.Pointer[Settings]
+
+	// Set by Attach: how to look up a user's account and channel status, and join or part channels.
+	whois         func(nick string)
+	channelStatus func(nick string) (member, voice, op bool)
+	join, part    func(channel string)
+
+	// whoisTimeout is how long commands wait for a WHOIS reply (the whoisTimeout constant).
+	whoisTimeout time.Duration
+
+	mu        sync.Mutex
+	receiving map[string]bool // partial upload files being written
+	whoisWait map[string]*whoisRound
+	whoisAcct map[string]string
+	bans      []string
+
+	transfers *transfer.Registry
+	queue     []*job
+	running   int            // transfers holding a slot
+	runningBy map[string]int // by owner
+
+	global       *ratelimit.Limiter
+	userLims     map[string]*userLimiter
+	transferLims map[*ratelimit.Limiter]bool
+
+	wg sync.WaitGroup // transfer goroutines
+}
+
+// New creates a Bot from cfg.
+func New(cfg *Config) *Bot {
+	b := &Bot{
+		root:      cfg.Root,
+		channel:   cfg.Channel,
+		relay:     cfg.Relay,
+		out:       cfg.Sender,
+		uploads:   cfg.Uploads,
+		freeSpace: cfg.FreeSpace,
+		reload:    cfg.Reload,
+		logger:    cfg.Logger,
+		debug:     cfg.Debug,
+		dccHost:   cfg.DCCHost,
+		started:   time.Now(),
+		receiving: make(map[string]bool),
+		whoisWait: make(map[string]*whoisRound),
+		whoisAcct: make(map[string]string),
+		transfers: transfer.NewRegistry(),
+		runningBy: make(map[string]int),
+
+		whoisTimeout: whoisTimeout,
+		global:       newLimiter(0),
+		userLims:     make(map[string]*userLimiter),
+		transferLims: make(map[*ratelimit.Limiter]bool),
+	}
+	b.Apply(&Settings{
+		MaxFileBytes:   cfg.MaxFileBytes,
+		MaxUploadBytes: cfg.MaxUploadBytes,
+		UserQuotaBytes: cfg.UserQuotaBytes,
+		MinFreeBytes:   cfg.MinFreeBytes,
+		ACL:            cfg.ACL,
+		Bans:           cfg.Bans,
+
+		MaxTransfers:        cfg.MaxTransfers,
+		MaxTransfersPerUser: cfg.MaxTransfersPerUser,
+		MaxQueuedPerUser:    cfg.MaxQueuedPerUser,
+
+		BandwidthBytes:         cfg.BandwidthBytes,
+		UserBandwidthBytes:     cfg.UserBandwidthBytes,
+		TransferBandwidthBytes: cfg.TransferBandwidthBytes,
+	})
+	if b.uploads == nil {
+		b.uploads, _ = fileshare.NewUploads(b.root, fileshare.ConflictReject)
+	}
+	if b.freeSpace == nil {
+		b.freeSpace = fileshare.FreeSpace
+	}
+	if b.logger == nil {
+		b.logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if b.dccHost == nil {
+		b.dccHost = dccHost
+	}
+	return b
+}
+
+// Apply replaces the bot's settings. Running transfers keep the size limits they started with;
+// new commands and queued transfers see the new settings at once.
+func (b *Bot) Apply(s *Settings) {
+	c := *s
+	if c.MaxFileBytes == 0 {
+		c.MaxFileBytes = DefaultMaxFileBytes
+	}
+	c.Bans = make([]string, len(s.Bans))
+	for i, mask := range s.Bans {
+		c.Bans[i] = banMask(mask)
+	}
+	b.cur.Store(&c)
+	b.setRates(&c)
+	b.dispatch() // limits may have gone up
+}
+
+// settings returns the current settings; callers must not modify them.
+func (b *Bot) settings() *Settings {
+	return b.cur.Load()
+}
+
+// dccHost resolves host to dotted-decimal IP for DCC CTCP; many clients only recognize numeric IPs.
+func dccHost(host string) string {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return host
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.String()
+		}
+	}
+	return host
+}
+
+// Message is an incoming PRIVMSG, CTCP or CTCP reply.
+type Message struct {
+	Nick   string
+	Ident  string
+	Host   string
+	Text   string // message text, or the CTCP arguments for HandleCTCP
+	Public bool   // sent to a channel rather than to the bot
+	// Account is the sender's services account, from the IRCv3 account-tag or WHOIS; "" if they
+	// are not logged in or it is not known.
+	Account string
+
+	accountKnown bool // Account is authoritative; no WHOIS needed
+}
+
+// Owner identifies the sender as the owner of their uploads: their services account if known,
+// otherwise ident@host, which survives nick changes, or the nick when the host is unknown.
+func (m *Message) Owner() string {
+	if m.Account != "" {
+		return "$a:" + m.Account
+	}
+	if m.Host == "" {
+		return m.Nick
+	}
+	return m.Ident + "@" + m.Host
+}
+
+// Attach registers the bot's PRIVMSG, CTCP and CTCPREPLY handlers on conn, and uses conn's state
+// tracking and WHOIS to find users' channel status and accounts for the ACL.
+func (b *Bot) Attach(conn *ircgo.Conn) {
+	b.whois = conn.Whois
+	b.join = func(channel string) { conn.Join(channel) }
+	b.part = func(channel string) { conn.Part(channel) }
+	b.channelStatus = func(nick string) (member, voice, op bool) {
+		st := conn.StateTracker()
+		if st == nil {
+			return false, false, false
+		}
+		p, ok := st.IsOn(b.channel, nick)
+		if !ok {
+			return false, false, false
+		}
+		op = p.Op || p.Admin || p.Owner
+		return true, op || p.HalfOp || p.Voice, op
+	}
+	// RPL_WHOISACCOUNT: Args = [me, nick, account, "is logged in as"]; RPL_ENDOFWHOIS and
+	// ERR_NOSUCHNICK: [me, nick, ...]. Some servers answer WHOIS of a missing nick with 401 alone.
+	conn.HandleFunc("330", func(c *ircgo.Conn, line *ircgo.Line) {
+		if len(line.Args) >= 3 {
+			b.whoisAccount(line.Args[1], line.Args[2])
+		}
+	})
+	conn.HandleFunc("318", func(c *ircgo.Conn, line *ircgo.Line) {
+		if len(line.Args) >= 2 {
+			b.whoisEnd(line.Args[1])
+		}
+	})
+	conn.HandleFunc("401", func(c *ircgo.Conn, line *ircgo.Line) {
+		if len(line.Args) >= 2 {
+			b.whoisEnd(line.Args[1])
+		}
+	})
+	// The replies to outstanding WHOIS will not come; drop the commands waiting for them.
+	conn.HandleFunc(ircgo.DISCONNECTED, func(c *ircgo.Conn, line *ircgo.Line) {
+		b.whoisReset()
+	})
+	// Transfers and queued requests follow their owner's nick, so nothing is sent to whoever takes
+	// the old one.
+	conn.HandleFunc(ircgo.NICK, func(c *ircgo.Conn, line *ircgo.Line) {
+		if len(line.Args) >= 1 {
+			b.nickChanged(line.Nick, line.Args[0])
+		}
+	})
+	conn.HandleFunc(ircgo.QUIT, func(c *ircgo.Conn, line *ircgo.Line) {
+		b.nickChanged(line.Nick, "")
+	})
+	messageFromLine := func(line *ircgo.Line, text string) *Message {
+		m := messageFromLine(line, text)
+		// With account-tag, a message without the tag is from someone who is not logged in.
+		m.accountKnown = m.Account != "" || conn.HasCapability(irc.CapAccountTag)
+		return m
+	}
+	conn.HandleFunc(ircgo.PRIVMSG, func(c *ircgo.Conn, line *ircgo.Line) {
+		b.HandleMessage(messageFromLine(line, line.Args[1]))
+	})
+	// DCC RESUME arrives as CTCP, not PRIVMSG (goirc parses \x01...\x01 and dispatches as CTCP).
+	// Line.Args = ["DCC", target, "RESUME filename port position"].
+	conn.HandleFunc(ircgo.CTCP, func(c *ircgo.Conn, line *ircgo.Line) {
+		if len(line.Args) < 3 {
+			return
+		}
+		b.HandleCTCP(line.Args[0], messageFromLine(line, line.Args[2]))
+	})
+	// DCC RESUME can also arrive as CTCPREPLY if the client sent it as NOTICE.
+	conn.HandleFunc(ircgo.CTCPREPLY, func(c *ircgo.Conn, line *ircgo.Line) {
+		if len(line.Args) < 3 {
+			return
+		}
+		b.HandleCTCP(line.Args[0], messageFromLine(line, line.Args[2]))
+	})
+}
+
+func messageFromLine(line *ircgo.Line, text string) *Message {
+	return &Message{
+		Nick:    line.Nick,
+		Ident:   line.Ident,
+		Host:    line.Host,
+		Text:    text,
+		Public:  line.Public(),
+		Account: line.Tags["account"],
+	}
+}
+
+// Transfers returns the registry of the bot's running transfers, for metrics.
+func (b *Bot) Transfers() *transfer.Registry {
+	return b.transfers
+}
+
+// Wait blocks until all transfers started by the bot have finished.
+func (b *Bot) Wait() {
+	b.wg.Wait()
+}
+
+// HandleMessage dispatches a PRIVMSG. Commands are accepted in private message only.
+func (b *Bot) HandleMessage(m *Message) {
+	defer b.guard("message from "+m.Nick, nil)
+	// Commands only in private message for now; channel handling reserved for later.
+	if m.Public {
+		return
+	}
+	msg := m.Text
+
+	if cmd, rest, ok := irc.ParseCTCP(msg); ok && irc.IsDCCSSEND(cmd, rest) {
+		if _, _, _, ok := irc.ParseDCCSSEND(rest); !ok {
+			b.reply(m, "Invalid DCC SSEND.")
+			return
+		}
+		b.reply(m, "To upload, use .upload first; I'll give you the relay address.")
+		return
+	}
+
+	// DCC RESUME: client wants to resume a download from a byte position.
+	// Use DCCResumeRestFromMessage so we recognize RESUME with or without CTCP \x01 delimiters.
+	if rest, ok := irc.DCCResumeRestFromMessage(msg); ok {
+		if b.debug {
+			b.logger.Printf("[debug] PRIVMSG RESUME rest=%q", rest)
+		}
+		b.run(m, func() { b.resume(m, rest) })
+		return
+	}
+
+	parts := strings.Fields(msg)
+	if len(parts) == 0 {
+		return
+	}
+	switch parts[0] {
+	case ".help", ".list", ".ls", ".download", ".get", ".upload", ".put", ".quota", ".queue", ".status",
+		".transfers", ".kill", ".ban", ".unban", ".reload", ".bandwidth", ".say", ".join", ".part", ".stats":
+		b.run(m, func() { b.command(m, parts) })
+	default:
+		// ignore
+	}
+}
+
+// command runs a command once the sender's account is known.
+func (b *Bot) command(m *Message, parts []string) {
+	switch parts[0] {
+	case ".help":
+		b.reply(m, ".list [-p page] [-s name|size|date] [dir/][pattern] (** recurses) | .download <file> | .put / .upload [-resume] [filename [size]] | .quota | .queue | .status  (PM only)")
+		if b.settings().ACL.Allowed(b.user(m), acl.Admin, "") {
+			b.reply(m, adminHelp)
+		}
+	case ".transfers", ".kill", ".ban", ".unban", ".reload", ".bandwidth", ".say", ".join", ".part", ".stats":
+		if b.allowed(m, acl.Admin, "") {
+			b.cmdAdmin(m, parts[0], parts[1:])
+		}
+	case ".list", ".ls":
+		b.cmdList(m, parts[1:])
+	case ".download", ".get":
+		b.cmdDownload(m, parts[1:])
+	case ".upload", ".put":
+		b.cmdUpload(m, parts[1:])
+	case ".quota":
+		b.cmdQuota(m)
+	case ".queue":
+		b.cmdQueue(m, parts[1:])
+	case ".status":
+		b.cmdStatus(m)
+	}
+}
+
+// HandleCTCP dispatches a CTCP request or reply; m.Text holds the CTCP arguments. Only private
+// DCC RESUME is handled.
+func (b *Bot) HandleCTCP(ctcp string, m *Message) {
+	defer b.guard("CTCP from "+m.Nick, nil)
+	if m.Public {
+		return
+	}
+	if ctcp != "DCC" || !strings.HasPrefix(strings.ToUpper(m.Text), "RESUME ") {
+		return
+	}
+	if b.debug {
+		b.logger.Printf("[debug] CTCP %s from %s rest=%q", ctcp, m.Nick, m.Text)
+	}
+	b.run(m, func() { b.resume(m, m.Text) })
+}
+
+// guard, deferred by handlers and transfer goroutines, logs a panic instead of letting it stop
+// the process and every other network. t, if not nil, is ended as failed.
+func (b *Bot) guard(what string, t *transfer.Transfer) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	b.logger.Printf("panic in %s: %v\n%s", what, r, debug.Stack())
+	if t != nil {
+		b.transfers.Finish(t, fmt.Errorf("panic: %v", r))
+	}
+}
+
+// reply answers m: by NOTICE to the channel for public messages, by PRIVMSG otherwise.
+func (b *Bot) reply(m *Message, text string) {
+	if m.Public {
+		b.out.Notice(b.channel, text)
+		return
+	}
+	b.out.Privmsg(m.Nick, text)
+}
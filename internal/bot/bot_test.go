@@ -0,0 +1,664 @@
+package bot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/fileshare"
+	"github.com/awgh/huzaa-bot/internal/ratelimit"
+	"github.com/awgh/huzaa-bot/internal/turnclient"
+)
+
+// fakeSender records everything the bot sends.
+type fakeSender struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (s *fakeSender) Privmsg(t, msg string) { s.add("PRIVMSG " + t + " :" + msg) }
+func (s *fakeSender) Notice(t, msg string)  { s.add("NOTICE " + t + " :" + msg) }
+func (s *fakeSender) CtcpReply(t, ctcp string, arg ...string) {
+	s.add("NOTICE " + t + " :\x01" + ctcp + " " + strings.Join(arg, " ") + "\x01")
+}
+
+func (s *fakeSender) add(line string) {
+	s.mu.Lock()
+	s.lines = append(s.lines, line)
+	s.mu.Unlock()
+}
+
+func (s *fakeSender) all() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+func (s *fakeSender) contains(sub string) bool {
+	for _, l := range s.all() {
+		if strings.Contains(l, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeDownload collects the bytes the bot streams. If hold is set, SendFile waits for it to close.
+type fakeDownload struct {
+	buf      bytes.Buffer
+	maxBytes int64
+	closed   bool
+	hold     chan struct{}
+	limiters []*ratelimit.Limiter
+}
+
+func (d *fakeDownload) SendFile(content io.Reader, maxBytes int64) error {
+	if d.hold != nil {
+		<-d.hold
+	}
+	d.maxBytes = maxBytes
+	if maxBytes > 0 {
+		content = io.LimitReader(content, maxBytes)
+	}
+	_, err := io.Copy(&d.buf, content)
+	return err
+}
+
+func (d *fakeDownload) SetLimiters(lims ...*ratelimit.Limiter) { d.limiters = lims }
+
+func (d *fakeDownload) Close() error {
+	d.closed = true
+	return nil
+}
+
+// fakeRelay hands out fake sessions; uploads stream uploadData, then fail with uploadErr if set,
+// or read from uploadStream if that is set. With hold, downloads wait until released.
+type fakeRelay struct {
+	err          error
+	uploadData   string
+	uploadErr    error
+	uploadStream io.ReadCloser
+	hold         bool
+
+	mu        sync.Mutex
+	downloads []*fakeDownload
+	names     []string
+}
+
+// started returns the names of the sessions registered so far.
+func (r *fakeRelay) started() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.names...)
+}
+
+func (r *fakeRelay) RegisterDownload(sessionID, filename string) (string, int, DownloadSession, error) {
+	if r.err != nil {
+		return "", 0, nil, r.err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := &fakeDownload{}
+	if r.hold {
+		d.hold = make(chan struct{})
+	}
+	r.downloads = append(r.downloads, d)
+	r.names = append(r.names, filename)
+	return "127.0.0.1", 40000, d, nil
+}
+
+// fakeStream is an upload stream; SetLimiters throttles nothing.
+type fakeStream struct{ io.ReadCloser }
+
+func (fakeStream) SetLimiters(...*ratelimit.Limiter) {}
+
+func (r *fakeRelay) RegisterUploadStream(sessionID, filename string) (string, int, UploadStream, error) {
+	if r.err != nil {
+		return "", 0, nil, r.err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = append(r.names, filename)
+	if r.uploadStream != nil {
+		return "127.0.0.1", 40001, fakeStream{r.uploadStream}, nil
+	}
+	var stream io.Reader = strings.NewReader(r.uploadData)
+	if r.uploadErr != nil {
+		stream = io.MultiReader(stream, &errReader{r.uploadErr})
+	}
+	return "127.0.0.1", 40001, fakeStream{io.NopCloser(stream)}, nil
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func newTestBot(t *testing.T, relay *fakeRelay) (*Bot, *fakeSender, string) {
+	t.Helper()
+	root := t.TempDir()
+	out := &fakeSender{}
+	b := New(&Config{
+		Root:           root,
+		Channel:        "#files",
+		Relay:          relay,
+		Sender:         out,
+		MaxUploadBytes: 1024,
+		Logger:         log.New(io.Discard, "", 0),
+		DCCHost:        func(host string) string { return host },
+	})
+	return b, out, root
+}
+
+// set changes b's settings the way .reload does.
+func set(b *Bot, change func(s *Settings)) {
+	s := *b.settings()
+	change(&s)
+	b.Apply(&s)
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestList(t *testing.T) {
+	b, out, root := newTestBot(t, &fakeRelay{})
+	writeFile(t, filepath.Join(root, "a.txt"), "a")
+	writeFile(t, filepath.Join(root, "b.pdf"), "b")
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".list *.txt"})
+	if !out.contains("PRIVMSG alice :a.txt") || out.contains("b.pdf") {
+		t.Errorf("got %q", out.all())
+	}
+}
+
+// listed returns the entry names of a .list reply, skipping the header line.
+func listed(lines []string) string {
+	var names []string
+	for _, l := range lines[1:] {
+		names = append(names, strings.Fields(strings.TrimPrefix(l, "PRIVMSG alice :"))[0])
+	}
+	return strings.Join(names, ",")
+}
+
+func TestListDirectories(t *testing.T) {
+	b, out, root := newTestBot(t, &fakeRelay{})
+	if err := os.MkdirAll(filepath.Join(root, "docs", "deep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "docs", "a.pdf"), "a")
+	writeFile(t, filepath.Join(root, "docs", "deep", "b.pdf"), "b")
+
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"", "docs/"},
+		{"docs", "docs/a.pdf,docs/deep/"},
+		{"docs/*.pdf", "docs/a.pdf"},
+		{"**/*.pdf", "docs/a.pdf,docs/deep/b.pdf"},
+	}
+	for _, tt := range tests {
+		out.lines = nil
+		b.HandleMessage(&Message{Nick: "alice", Text: ".list " + tt.arg})
+		if got := listed(out.all()); got != tt.want {
+			t.Errorf(".list %s = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+	out.lines = nil
+	b.HandleMessage(&Message{Nick: "alice", Text: ".list ../"})
+	if !out.contains("PRIVMSG alice :List error:") {
+		t.Errorf("got %q", out.all())
+	}
+}
+
+func TestListPages(t *testing.T) {
+	b, out, root := newTestBot(t, &fakeRelay{})
+	mtime := time.Date(2024, 3, 1, 12, 30, 0, 0, time.Local)
+	for i := 0; i < ListPageSize+2; i++ {
+		name := filepath.Join(root, fmt.Sprintf("f%02d.txt", i))
+		writeFile(t, name, strings.Repeat("x", i))
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := mtime.Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "f05.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".list"})
+	l := out.all()
+	if len(l) != ListPageSize+1 || !strings.Contains(l[0], "page 1/2") || !strings.Contains(l[0], "next: .list -p 2") {
+		t.Fatalf("page 1 = %q", l)
+	}
+	if l[2] != "PRIVMSG alice :f01.txt  1 B  2024-03-01 12:30" {
+		t.Errorf("entry line = %q", l[2])
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{".list -p 2", "f10.txt,f11.txt"},
+		{".list -s size -p 2 *.txt", "f01.txt,f00.txt"},
+		{".list -s date -p 2", "f11.txt,f05.txt"},
+	}
+	for _, tt := range tests {
+		out.lines = nil
+		b.HandleMessage(&Message{Nick: "alice", Text: tt.text})
+		if got := listed(out.all()); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.text, got, tt.want)
+		}
+	}
+
+	for _, text := range []string{".list -p 3", ".list -p x", ".list -s colour", ".list a b"} {
+		out.lines = nil
+		b.HandleMessage(&Message{Nick: "alice", Text: text})
+		if l := out.all(); len(l) != 1 || (!strings.Contains(l[0], "Usage: .list") && !strings.Contains(l[0], "No page 3")) {
+			t.Errorf("%s = %q", text, l)
+		}
+	}
+}
+
+func TestDownloadNested(t *testing.T) {
+	relay := &fakeRelay{}
+	b, out, root := newTestBot(t, relay)
+	if err := os.Mkdir(filepath.Join(root, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "docs", "a.txt"), "nested")
+	b.HandleMessage(&Message{Nick: "alice", Text: ".get docs/a.txt"})
+	b.Wait()
+	if !out.contains("\x01DCC SSEND a.txt ") || relay.downloads[0].buf.String() != "nested" {
+		t.Errorf("got %q", out.all())
+	}
+}
+
+func TestDownload(t *testing.T) {
+	relay := &fakeRelay{}
+	b, out, root := newTestBot(t, relay)
+	writeFile(t, filepath.Join(root, "a.txt"), "hello")
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download a.txt"})
+	b.Wait()
+	if !out.contains("PRIVMSG alice :\x01DCC SSEND a.txt 127.0.0.1 40000 5\x01") {
+		t.Fatalf("no SSEND line in %q", out.all())
+	}
+	if len(relay.downloads) != 1 || relay.downloads[0].buf.String() != "hello" || !relay.downloads[0].closed {
+		t.Errorf("download session not streamed and closed: %+v", relay.downloads)
+	}
+}
+
+func TestDownloadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"usage", ".download", "Usage: .download <filename>"},
+		{"traversal", ".get ../etc/passwd", "Invalid path."},
+		{"missing", ".get nope.txt", "File not found."},
+		{"directory", ".get sub", "Not a file."},
+		{"empty", ".get empty.txt", "File is empty; cannot send."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := &fakeRelay{}
+			b, out, root := newTestBot(t, relay)
+			writeFile(t, filepath.Join(root, "empty.txt"), "")
+			if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			b.HandleMessage(&Message{Nick: "alice", Text: tt.text})
+			if !out.contains("PRIVMSG alice :" + tt.want) {
+				t.Errorf("want %q, got %q", tt.want, out.all())
+			}
+			if len(relay.downloads) != 0 {
+				t.Error("relay session registered for rejected download")
+			}
+		})
+	}
+}
+
+func TestDownloadRelayError(t *testing.T) {
+	b, out, root := newTestBot(t, &fakeRelay{err: errors.New("down")})
+	writeFile(t, filepath.Join(root, "a.txt"), "hello")
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download a.txt"})
+	if !out.contains("Relay error: down") {
+		t.Errorf("got %q", out.all())
+	}
+}
+
+func TestUpload(t *testing.T) {
+	relay := &fakeRelay{uploadData: "uploaded"}
+	b, out, root := newTestBot(t, relay)
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload ../x/new.txt"})
+	b.Wait()
+	if !out.contains("\x01DCC SRECV new.txt 127.0.0.1 40001 0\x01") {
+		t.Fatalf("no SRECV line in %q", out.all())
+	}
+	data, err := os.ReadFile(filepath.Join(root, "new.txt"))
+	if err != nil || string(data) != "uploaded" {
+		t.Errorf("uploaded file = %q, %v", data, err)
+	}
+}
+
+func TestUploadAborted(t *testing.T) {
+	relay := &fakeRelay{uploadData: "partial", uploadErr: io.ErrUnexpectedEOF}
+	b, out, root := newTestBot(t, relay)
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload new.txt"})
+	b.Wait()
+	if entries, _ := fileshare.ListDir(root, "", ""); len(entries) != 0 {
+		t.Errorf("aborted upload is visible: %v", entries)
+	}
+	if !out.contains("PRIVMSG alice :Upload of new.txt failed after 7 B: the connection was lost. Use .upload -resume new.txt to continue from 7 B.") {
+		t.Fatalf("got %q", out.all())
+	}
+
+	// Resuming sends SRECV at the partial size and appends the rest.
+	relay.uploadData, relay.uploadErr = " and the rest", nil
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload -resume new.txt"})
+	b.Wait()
+	if !out.contains("\x01DCC SRECV new.txt 127.0.0.1 40001 7\x01") {
+		t.Fatalf("no resume SRECV in %q", out.all())
+	}
+	data, err := os.ReadFile(filepath.Join(root, "new.txt"))
+	if err != nil || string(data) != "partial and the rest" {
+		t.Errorf("resumed file = %q, %v", data, err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 2 { // new.txt and .owners.json
+		t.Errorf("partial left after resume: %v", entries)
+	}
+}
+
+func TestUploadResumeErrors(t *testing.T) {
+	relay := &fakeRelay{uploadData: "fresh"}
+	b, out, root := newTestBot(t, relay)
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload -resume new.txt"})
+	if !out.contains("No partial upload of new.txt to resume.") {
+		t.Errorf("got %q", out.all())
+	}
+	// Another user's partial is not theirs to resume, and a plain .upload starts over.
+	partial := b.uploads.PartialPath("new.txt", "alice")
+	writeFile(t, partial, "old partial")
+	b.HandleMessage(&Message{Nick: "bob", Text: ".upload -resume new.txt"})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload new.txt"})
+	b.Wait()
+	if !out.contains("PRIVMSG bob :No partial upload") || !out.contains("You have a partial upload of new.txt (11 B)") {
+		t.Errorf("got %q", out.all())
+	}
+	data, err := os.ReadFile(filepath.Join(root, "new.txt"))
+	if err != nil || string(data) != "fresh" {
+		t.Errorf("restarted file = %q, %v", data, err)
+	}
+}
+
+func TestUploadConflict(t *testing.T) {
+	tests := []struct {
+		policy string
+		nick   string
+		reply  string
+		stored string // file holding the upload, "" if rejected
+	}{
+		{fileshare.ConflictReject, "alice", "a.txt already exists", ""},
+		{fileshare.ConflictRename, "bob", "upload as a-1.txt", "a-1.txt"},
+		{fileshare.ConflictVersion, "bob", "upload as a.txt", "a.txt"},
+		{fileshare.ConflictOwner, "alice", "upload as a.txt", "a.txt"},
+		{fileshare.ConflictOwner, "bob", "a.txt already exists", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.nick, func(t *testing.T) {
+			relay := &fakeRelay{uploadData: "first"}
+			b, out, root := newTestBot(t, relay)
+			b.uploads, _ = fileshare.NewUploads(root, tt.policy)
+			b.HandleMessage(&Message{Nick: "alice", Ident: "a", Host: "alice.example", Text: ".upload a.txt"})
+			b.Wait()
+
+			out.lines = nil
+			relay.uploadData = "second"
+			b.HandleMessage(&Message{Nick: tt.nick, Ident: tt.nick[:1], Host: tt.nick + ".example", Text: ".upload a.txt"})
+			b.Wait()
+			if !out.contains(tt.reply) {
+				t.Errorf("want %q, got %q", tt.reply, out.all())
+			}
+			if tt.stored == "" {
+				if len(relay.names) != 1 {
+					t.Errorf("relay session registered for rejected upload: %q", relay.names)
+				}
+				return
+			}
+			data, err := os.ReadFile(filepath.Join(root, tt.stored))
+			if err != nil || string(data) != "second" {
+				t.Errorf("%s = %q, %v", tt.stored, data, err)
+			}
+			// The stored name can be downloaded.
+			b.HandleMessage(&Message{Nick: tt.nick, Ident: tt.nick[:1], Host: tt.nick + ".example", Text: ".download " + tt.stored})
+			b.Wait()
+			if !out.contains("\x01DCC SSEND " + tt.stored + " ") {
+				t.Errorf("download of %s: %q", tt.stored, out.all())
+			}
+		})
+	}
+}
+
+func TestHiddenFiles(t *testing.T) {
+	relay := &fakeRelay{}
+	b, out, root := newTestBot(t, relay)
+	writeFile(t, filepath.Join(root, ".a.txt.123.part"), "partial")
+	for _, text := range []string{".list", ".get .a.txt.123.part", ".upload .sneaky"} {
+		b.HandleMessage(&Message{Nick: "alice", Text: text})
+	}
+	if out.contains(".part  ") || !out.contains("File not found.") || !out.contains("Invalid filename.") {
+		t.Errorf("got %q", out.all())
+	}
+	if len(relay.names) != 0 {
+		t.Errorf("relay sessions registered: %q", relay.names)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	relay := &fakeRelay{uploadData: strings.Repeat("x", 1025)}
+	b, out, root := newTestBot(t, relay) // MaxUploadBytes 1024
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload big.bin"})
+	b.Wait()
+	if !out.contains("Upload of big.bin discarded: it went over the upload limit of 1.0 KiB.") {
+		t.Errorf("got %q", out.all())
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("oversized upload left %v", entries)
+	}
+
+	relay.uploadData = strings.Repeat("x", 1024)
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload exact.bin"})
+	b.Wait()
+	if info, err := os.Stat(filepath.Join(root, "exact.bin")); err != nil || info.Size() != 1024 {
+		t.Errorf("upload at the limit: %v, %v", info, err)
+	}
+}
+
+func TestUploadDeclaredSize(t *testing.T) {
+	relay := &fakeRelay{uploadData: "small"}
+	b, out, root := newTestBot(t, relay)
+	for _, text := range []string{".upload big.bin 2048", ".upload big.bin lots", ".upload a b c"} {
+		b.HandleMessage(&Message{Nick: "alice", Text: text})
+	}
+	if !out.contains("Too large: 2.0 KiB is over the upload limit of 1.0 KiB.") || !out.contains("Usage: .upload") {
+		t.Errorf("got %q", out.all())
+	}
+	if len(relay.names) != 0 {
+		t.Errorf("relay sessions registered for refused uploads: %q", relay.names)
+	}
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload small.txt 5"})
+	b.Wait()
+	if _, err := os.Stat(filepath.Join(root, "small.txt")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	relay := &fakeRelay{uploadData: "123456"}
+	b, out, root := newTestBot(t, relay)
+	set(b, func(s *Settings) { s.UserQuotaBytes = 10 })
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload a.txt"})
+	b.Wait()
+	b.HandleMessage(&Message{Nick: "alice", Text: ".quota"})
+	if !out.contains("You have uploaded 6 B of your 10 B quota; 4 B left.") {
+		t.Errorf("got %q", out.all())
+	}
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload b.txt 5"})
+	if !out.contains("Upload refused: over your upload quota of 10 B (see .quota).") || len(relay.names) != 1 {
+		t.Errorf("declared size over quota: %q, sessions %q", out.all(), relay.names)
+	}
+	// Without a declared size the upload is stopped once it goes over.
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload b.txt"})
+	b.Wait()
+	if !out.contains("Upload of b.txt discarded: over your upload quota") {
+		t.Errorf("got %q", out.all())
+	}
+	if _, err := os.Stat(filepath.Join(root, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("upload over quota was stored: %v", err)
+	}
+	// Other users have their own quota.
+	b.HandleMessage(&Message{Nick: "bob", Text: ".upload b.txt"})
+	b.Wait()
+	if _, err := os.Stat(filepath.Join(root, "b.txt")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQuotaPartial(t *testing.T) {
+	relay := &fakeRelay{uploadData: "1234", uploadErr: io.ErrUnexpectedEOF}
+	b, out, _ := newTestBot(t, relay)
+	set(b, func(s *Settings) { s.UserQuotaBytes = 10 })
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload a.txt"})
+	b.Wait()
+	b.HandleMessage(&Message{Nick: "alice", Text: ".quota"})
+	if !out.contains("You have uploaded 4 B of your 10 B quota; 6 B left.") {
+		t.Errorf("partial upload not counted: %q", out.all())
+	}
+	// Resuming counts the partial once.
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload -resume a.txt 10"})
+	if out.contains("Upload refused") || len(relay.names) != 2 {
+		t.Errorf("resume refused: %q", out.all())
+	}
+	b.Wait()
+}
+
+func TestMinFree(t *testing.T) {
+	relay := &fakeRelay{uploadData: "123456"}
+	b, out, _ := newTestBot(t, relay)
+	free := int64(100)
+	set(b, func(s *Settings) { s.MinFreeBytes = 50 })
+	b.freeSpace = func(string) (int64, error) { return free, nil }
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload a.txt 60"})
+	if !out.contains("Upload refused: not enough free disk space.") {
+		t.Errorf("got %q", out.all())
+	}
+	b.HandleMessage(&Message{Nick: "alice", Text: ".quota"})
+	if !out.contains("no per-user quota. Space available for uploads: 50 B.") {
+		t.Errorf("got %q", out.all())
+	}
+	free = 40
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload a.txt"})
+	if !out.contains("Upload refused: not enough free disk space.") || len(relay.names) != 0 {
+		t.Errorf("got %q, sessions %q", out.all(), relay.names)
+	}
+}
+
+func TestUploadNoData(t *testing.T) {
+	b, out, root := newTestBot(t, &fakeRelay{})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload empty.txt"})
+	b.Wait()
+	if _, err := os.Stat(filepath.Join(root, "empty.txt")); !os.IsNotExist(err) {
+		t.Errorf("file created for upload without data: %v", err)
+	}
+	if !out.contains("PRIVMSG alice :Upload of empty.txt failed: no data received") {
+		t.Errorf("got %q", out.all())
+	}
+
+	// An error before the first byte is reported as it is.
+	b, out, _ = newTestBot(t, &fakeRelay{uploadErr: turnclient.ErrAcceptTimeout})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload late.txt"})
+	b.Wait()
+	if !out.contains("PRIVMSG alice :Upload of late.txt failed: your client did not connect in time.") {
+		t.Errorf("got %q", out.all())
+	}
+}
+
+// panicReader panics on Read.
+type panicReader struct{}
+
+func (panicReader) Read([]byte) (int, error) { panic("boom") }
+func (panicReader) Close() error             { return nil }
+
+func TestTransferPanic(t *testing.T) {
+	b, _, _ := newTestBot(t, &fakeRelay{uploadStream: panicReader{}})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload a.txt"})
+	b.Wait()
+	if n := len(b.Transfers().List()); n != 0 || b.Transfers().Totals().Failed != 1 {
+		t.Errorf("%d running, totals %+v", n, b.Transfers().Totals())
+	}
+}
+
+func TestResume(t *testing.T) {
+	deliveries := map[string]func(b *Bot){
+		"privmsg": func(b *Bot) {
+			b.HandleMessage(&Message{Nick: "alice", Text: "\x01DCC RESUME a.txt 40000 6\x01"})
+		},
+		"privmsg without delimiters": func(b *Bot) {
+			b.HandleMessage(&Message{Nick: "alice", Text: "DCC RESUME a.txt 40000 6"})
+		},
+		"ctcp": func(b *Bot) {
+			b.HandleCTCP("DCC", &Message{Nick: "alice", Text: "RESUME a.txt 40000 6"})
+		},
+	}
+	for name, deliver := range deliveries {
+		t.Run(name, func(t *testing.T) {
+			relay := &fakeRelay{}
+			b, out, root := newTestBot(t, relay)
+			writeFile(t, filepath.Join(root, "a.txt"), "hello world")
+			deliver(b)
+			b.Wait()
+			if !out.contains("NOTICE alice :\x01DCC ACCEPT a.txt 40000 6\x01") {
+				t.Fatalf("no ACCEPT in %q", out.all())
+			}
+			if len(relay.downloads) != 1 || relay.downloads[0].buf.String() != "world" {
+				t.Errorf("resumed data = %+v", relay.downloads)
+			}
+		})
+	}
+}
+
+func TestResumeInvalidPosition(t *testing.T) {
+	relay := &fakeRelay{}
+	b, out, root := newTestBot(t, relay)
+	writeFile(t, filepath.Join(root, "a.txt"), "hello")
+	b.HandleCTCP("DCC", &Message{Nick: "alice", Text: "RESUME a.txt 40000 5"})
+	if !out.contains("Resume position invalid.") || len(relay.downloads) != 0 {
+		t.Errorf("got %q", out.all())
+	}
+}
+
+func TestPublicIgnored(t *testing.T) {
+	b, out, root := newTestBot(t, &fakeRelay{})
+	writeFile(t, filepath.Join(root, "a.txt"), "a")
+	b.HandleMessage(&Message{Nick: "alice", Text: ".list", Public: true})
+	b.HandleCTCP("DCC", &Message{Nick: "alice", Text: "RESUME a.txt 1 0", Public: true})
+	if len(out.all()) != 0 {
+		t.Errorf("replied to channel: %q", out.all())
+	}
+}
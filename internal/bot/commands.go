@@ -0,0 +1,601 @@
+package bot
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/acl"
+	"github.com/awgh/huzaa-bot/internal/fileshare"
+	"github.com/awgh/huzaa-bot/internal/irc"
+	"github.com/awgh/huzaa-bot/internal/transfer"
+	"github.com/awgh/huzaa-bot/internal/turnclient"
+)
+
+// ListPageSize is the number of entries .list shows per page.
+const ListPageSize = 10
+
+const listUsage = "Usage: .list [-p page] [-s name|size|date] [dir/][pattern]"
+
+// cmdList handles ".list [-p page] [-s name|size|date] [dir/][pattern]" and recursive
+// ".list **/pattern". Each entry goes on its own line so long listings never hit the IRC line limit.
+func (b *Bot) cmdList(m *Message, args []string) {
+	page, sortBy, arg := 1, fileshare.SortName, ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case (args[i] == "-p" || args[i] == "-s") && i+1 < len(args):
+			if args[i] == "-s" {
+				sortBy = args[i+1]
+			} else if n, err := strconv.Atoi(args[i+1]); err == nil && n > 0 {
+				page = n
+			} else {
+				b.reply(m, listUsage)
+				return
+			}
+			i++
+		case strings.HasPrefix(args[i], "-") || arg != "":
+			b.reply(m, listUsage)
+			return
+		default:
+			arg = args[i]
+		}
+	}
+	u, access := b.user(m), b.settings().ACL
+	dir, entries, err := b.list(arg)
+	if !access.Visible(u, dir) {
+		b.reply(m, "Permission denied.")
+		return
+	}
+	if err != nil {
+		b.reply(m, "List error: "+err.Error())
+		return
+	}
+	visible := entries[:0]
+	for _, e := range entries {
+		if access.Visible(u, e.Path) {
+			visible = append(visible, e)
+		}
+	}
+	entries = visible
+	if len(entries) == 0 {
+		b.reply(m, "No files.")
+		return
+	}
+	if err := fileshare.SortEntries(entries, sortBy); err != nil {
+		b.reply(m, listUsage)
+		return
+	}
+	pages := (len(entries) + ListPageSize - 1) / ListPageSize
+	if page > pages {
+		b.reply(m, "No page "+strconv.Itoa(page)+"; there are "+strconv.Itoa(pages)+".")
+		return
+	}
+	noun := " entries"
+	if len(entries) == 1 {
+		noun = " entry"
+	}
+	header := strconv.Itoa(len(entries)) + noun + ", page " + strconv.Itoa(page) + "/" + strconv.Itoa(pages) + " by " + sortBy
+	if page < pages {
+		next := ".list -p " + strconv.Itoa(page+1)
+		if sortBy != fileshare.SortName {
+			next += " -s " + sortBy
+		}
+		if arg != "" {
+			next += " " + arg
+		}
+		header += " (next: " + next + ")"
+	}
+	b.reply(m, header)
+	end := page * ListPageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+	for _, e := range entries[(page-1)*ListPageSize : end] {
+		b.reply(m, listLine(e))
+	}
+}
+
+// listLine formats one .list entry as "name  size  mtime"; directories have no size.
+func listLine(e fileshare.Entry) string {
+	size := "-"
+	if !e.IsDir {
+		size = fileshare.FormatSize(e.Size)
+	}
+	return e.Name() + "  " + size + "  " + e.ModTime.Format("2006-01-02 15:04")
+}
+
+// list resolves a .list argument: "" lists the root, "docs/" a directory, "docs/*.pdf" a pattern
+// within a directory and anything containing "**" is a recursive glob from the root. It also returns
+// the directory listed, for the permission check.
+func (b *Bot) list(arg string) (string, []fileshare.Entry, error) {
+	if arg == "" {
+		entries, err := fileshare.ListDir(b.root, "", "")
+		return "", entries, err
+	}
+	if strings.Contains(arg, "**") {
+		entries, err := fileshare.Glob(b.root, arg)
+		return "", entries, err
+	}
+	if p, err := fileshare.SafePath(b.root, arg); err == nil {
+		if info, err := os.Stat(p); err == nil && info.IsDir() {
+			entries, err := fileshare.ListDir(b.root, arg, "")
+			return arg, entries, err
+		}
+	}
+	dir, pattern := path.Split(arg)
+	entries, err := fileshare.ListDir(b.root, dir, pattern)
+	return dir, entries, err
+}
+
+func (b *Bot) cmdDownload(m *Message, args []string) {
+	if len(args) < 1 {
+		b.reply(m, "Usage: .download <filename>")
+		return
+	}
+	filename := args[0]
+	safePath, err := fileshare.SafePath(b.root, filename)
+	if err != nil {
+		b.reply(m, "Invalid path.")
+		return
+	}
+	if fileshare.IsHidden(filename) {
+		b.reply(m, "File not found.")
+		return
+	}
+	if !b.allowed(m, acl.Download, filename) {
+		return
+	}
+	f, err := os.Open(safePath)
+	if err != nil {
+		b.reply(m, "File not found.")
+		return
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		b.reply(m, "Not a file.")
+		return
+	}
+	size := info.Size()
+	if size == 0 {
+		f.Close()
+		b.reply(m, "File is empty; cannot send.")
+		return
+	}
+	maxFile := b.settings().MaxFileBytes
+	if maxFile > 0 && size > maxFile {
+		f.Close()
+		b.reply(m, "File too large.")
+		return
+	}
+	b.enqueue(m, "download of "+filename, func() bool {
+		return b.startDownload(m, f, filename, size, maxFile)
+	}, func() { f.Close() })
+}
+
+// startDownload registers a relay session for f and offers it with DCC SSEND. It returns false,
+// closing f, if the session could not be set up.
+func (b *Bot) startDownload(m *Message, f *os.File, filename string, size, maxFile int64) bool {
+	sessionID, err := turnclient.GenerateSessionID()
+	if err != nil {
+		f.Close()
+		b.reply(m, "Error creating session.")
+		return false
+	}
+	host, port, sess, err := b.relay.RegisterDownload(sessionID, filepath.Base(filename))
+	if err != nil {
+		f.Close()
+		b.reply(m, "Relay error: "+err.Error())
+		return false
+	}
+	lims, unthrottle := b.limiters(m.Owner())
+	sess.SetLimiters(lims...)
+	ctcpMsg := "\x01DCC SSEND " + filepath.Base(filename) + " " + b.dccHost(host) + " " + strconv.Itoa(port) + " " + strconv.FormatInt(size, 10) + "\x01"
+	b.out.Privmsg(m.Nick, ctcpMsg)
+	t := b.transfers.Start(sessionID, m.Owner(), m.Nick, filename, transfer.Download, 0, size, sess.Close)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer b.guard("download of "+filename, t)
+		defer b.release(m.Owner())
+		defer unthrottle()
+		defer f.Close()
+		defer sess.Close()
+		err := sess.SendFile(t.Reader(f), maxFile)
+		if err != nil {
+			b.logger.Printf("send file: %v", err)
+		}
+		b.finish(t, err)
+	}()
+	b.reply(m, "Accept in your client to download from relay.")
+	return true
+}
+
+// resume handles "RESUME filename port position": the client wants the rest of a download from position.
+func (b *Bot) resume(m *Message, rest string) {
+	resumeFilename, _, position, ok := irc.ParseDCCResume(rest)
+	if !ok {
+		return
+	}
+	if b.debug {
+		b.logger.Printf("[debug] RESUME parsed filename=%q position=%d replyTo=%s", resumeFilename, position, m.Nick)
+	}
+	safePath, err := fileshare.SafePath(b.root, resumeFilename)
+	if err != nil {
+		b.reply(m, "Invalid path.")
+		return
+	}
+	if fileshare.IsHidden(resumeFilename) {
+		b.reply(m, "File not found.")
+		return
+	}
+	if !b.allowed(m, acl.Download, resumeFilename) {
+		return
+	}
+	f, err := os.Open(safePath)
+	if err != nil {
+		b.reply(m, "File not found.")
+		return
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		b.reply(m, "Not a file.")
+		return
+	}
+	size := info.Size()
+	if position < 0 || position >= size {
+		f.Close()
+		b.reply(m, "Resume position invalid.")
+		return
+	}
+	b.enqueue(m, "resume of "+resumeFilename, func() bool {
+		return b.startResume(m, f, resumeFilename, position, size)
+	}, func() { f.Close() })
+}
+
+// startResume registers a relay session for the rest of f from position and answers with DCC
+// ACCEPT. It returns false, closing f, if the session could not be set up.
+func (b *Bot) startResume(m *Message, f *os.File, resumeFilename string, position, size int64) bool {
+	sessionID, err := turnclient.GenerateSessionID()
+	if err != nil {
+		f.Close()
+		b.reply(m, "Error creating session.")
+		return false
+	}
+	name := filepath.Base(resumeFilename)
+	_, port, sess, err := b.relay.RegisterDownload(sessionID, name)
+	if err != nil {
+		f.Close()
+		b.reply(m, "Relay error: "+err.Error())
+		return false
+	}
+	lims, unthrottle := b.limiters(m.Owner())
+	sess.SetLimiters(lims...)
+	if b.debug {
+		b.logger.Printf("[debug] sending ACCEPT (NOTICE): %q", irc.DCCAcceptCTCP(name, port, position))
+	}
+	// CTCP replies (e.g. DCC ACCEPT) must be sent as NOTICE so the client recognizes them.
+	b.out.CtcpReply(m.Nick, "DCC ACCEPT", name, strconv.Itoa(port), strconv.FormatInt(position, 10))
+	t := b.transfers.Start(sessionID, m.Owner(), m.Nick, resumeFilename, transfer.Download, position, size, sess.Close)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer b.guard("download of "+resumeFilename, t)
+		defer b.release(m.Owner())
+		defer unthrottle()
+		defer f.Close()
+		defer sess.Close()
+		if _, err := f.Seek(position, io.SeekStart); err != nil {
+			b.logger.Printf("resume seek: %v", err)
+			b.finish(t, err)
+			return
+		}
+		remaining := size - position
+		if maxFile := b.settings().MaxFileBytes; maxFile > 0 && remaining > maxFile {
+			remaining = maxFile
+		}
+		err := sess.SendFile(t.Reader(f), remaining)
+		if err != nil {
+			b.logger.Printf("resume send: %v", err)
+		}
+		b.finish(t, err)
+	}()
+	b.reply(m, "Resume accepted; connect in your client to continue from byte "+strconv.FormatInt(position, 10)+".")
+	return true
+}
+
+// Errors that end an upload early. The partial file is discarded.
+var (
+	errTooLarge = errors.New("upload exceeds the size limit")
+	errQuota    = errors.New("upload quota exceeded")
+	errDiskFull = errors.New("not enough free disk space")
+)
+
+// errNoData is an upload's outcome when the client connected but sent nothing.
+var errNoData = errors.New("no data received")
+
+// capReader passes through at most n bytes of r and fails with errTooLarge if r has more, so an
+// oversized upload is detected instead of being silently truncated.
+type capReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *capReader) Read(p []byte) (int, error) {
+	if c.n <= 0 {
+		// Probe for one more byte: a clean EOF here means the upload was exactly at the limit.
+		var one [1]byte
+		n, err := c.r.Read(one[:])
+		if n > 0 {
+			return 0, errTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	return n, err
+}
+
+const uploadUsage = "Usage: .upload [-resume] [filename [size]]"
+
+// cmdUpload handles ".upload [filename [size]]" and ".upload -resume <filename> [size]". An
+// interrupted upload is kept as a hidden partial file; -resume offers DCC SRECV at its size so the
+// client sends only the rest. A declared size lets oversized uploads be refused before a relay
+// session is allocated.
+func (b *Bot) cmdUpload(m *Message, args []string) {
+	resume := len(args) > 0 && args[0] == "-resume"
+	if resume {
+		args = args[1:]
+		if len(args) == 0 {
+			b.reply(m, uploadUsage)
+			return
+		}
+	}
+	if len(args) > 2 {
+		b.reply(m, uploadUsage)
+		return
+	}
+	filename := ""
+	if len(args) > 0 {
+		filename = args[0]
+	}
+	size := int64(-1) // unknown
+	if len(args) == 2 {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || n < 0 {
+			b.reply(m, uploadUsage)
+			return
+		}
+		size = n
+	}
+	maxUpload := b.settings().MaxUploadBytes
+	if maxUpload > 0 && size > maxUpload {
+		b.reply(m, "Too large: "+fileshare.FormatSize(size)+" is over the upload limit of "+fileshare.FormatSize(maxUpload)+".")
+		return
+	}
+	filename = filepath.Base(filename)
+	if filename == "" || filename == "." {
+		filename = "upload-" + time.Now().Format("20060102-150405")
+	}
+	if _, err := fileshare.SafePath(b.root, filename); err != nil || fileshare.IsHidden(filename) {
+		b.reply(m, "Invalid filename.")
+		return
+	}
+	if !b.allowed(m, acl.Upload, filename) {
+		return
+	}
+	stored, err := b.uploads.Name(filename, m.Owner())
+	if errors.Is(err, fileshare.ErrExists) {
+		b.reply(m, filename+" already exists; choose another name.")
+		return
+	}
+	if err != nil {
+		b.reply(m, "Upload error: "+err.Error())
+		return
+	}
+	b.expirePartials()
+	partial := b.uploads.PartialPath(filename, m.Owner())
+	var position int64
+	if info, err := os.Stat(partial); err == nil {
+		position = info.Size()
+	}
+	if resume && position == 0 {
+		b.reply(m, "No partial upload of "+filename+" to resume.")
+		return
+	}
+	if resume && maxUpload > 0 && position >= maxUpload {
+		os.Remove(partial)
+		b.reply(m, "Your partial upload of "+filename+" is already at the upload limit of "+fileshare.FormatSize(maxUpload)+"; it has been discarded.")
+		return
+	}
+	if !resume && position > 0 {
+		b.reply(m, "You have a partial upload of "+filename+" ("+fileshare.FormatSize(position)+"); it will be replaced. Use .upload -resume "+filename+" to continue it instead.")
+		position = 0
+	}
+	pending := int64(0)
+	if size > position {
+		pending = size - position
+	}
+	if err := b.checkSpace(m.Owner(), partial, position+pending, pending); err != nil {
+		b.reply(m, "Upload refused: "+b.spaceError(err)+".")
+		return
+	}
+	if !b.startReceiving(partial) {
+		b.reply(m, "Your upload of "+filename+" is already in progress.")
+		return
+	}
+	b.enqueue(m, "upload of "+stored, func() bool {
+		return b.startUpload(m, filename, stored, partial, position, size, maxUpload)
+	}, func() { b.stopReceiving(partial) })
+}
+
+// startUpload registers a relay session for an upload of filename (to be stored as stored) and
+// offers it with DCC SRECV at position. It returns false, releasing partial, if the session could
+// not be set up.
+func (b *Bot) startUpload(m *Message, filename, stored, partial string, position, size, maxUpload int64) bool {
+	sessionID, err := turnclient.GenerateSessionID()
+	if err != nil {
+		b.stopReceiving(partial)
+		b.reply(m, "Error creating session.")
+		return false
+	}
+	host, port, stream, err := b.relay.RegisterUploadStream(sessionID, stored)
+	if err != nil {
+		b.stopReceiving(partial)
+		b.reply(m, "Relay error: "+err.Error())
+		return false
+	}
+	lims, unthrottle := b.limiters(m.Owner())
+	stream.SetLimiters(lims...)
+	t := b.transfers.Start(sessionID, m.Owner(), m.Nick, stored, transfer.Upload, position, size, stream.Close)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer b.guard("upload of "+stored, t)
+		defer b.release(m.Owner())
+		defer unthrottle()
+		defer b.stopReceiving(partial)
+		defer stream.Close()
+		r := t.Reader(stream)
+		if maxUpload > 0 {
+			r = &capReader{r: r, n: maxUpload - position}
+		}
+		if s := b.settings(); s.UserQuotaBytes > 0 || s.MinFreeBytes > 0 {
+			r = &spaceReader{r: r, check: func(received int64) error {
+				return b.checkSpace(m.Owner(), partial, position+received, 0)
+			}}
+		}
+		// Don't touch the partial file until we receive at least one byte (avoids empty "upload" from failed/abandoned transfers).
+		buf := make([]byte, 1)
+		n, err := r.Read(buf)
+		if n == 0 {
+			if err == nil || err == io.EOF {
+				err = errNoData
+			}
+			b.finish(t, err)
+			return // no data received, create nothing
+		}
+		final, err := b.receive(m, filename, partial, position, io.MultiReader(bytes.NewReader(buf[:n]), r))
+		if final != "" {
+			if err != nil {
+				b.logger.Printf("upload %s: stored as %s, but: %v", filename, final, err)
+			}
+			b.finish(t, nil) // stored, even if recording the owner failed
+			if final != stored {
+				b.notify(t, "Upload stored as "+final+".")
+			}
+			return
+		}
+		b.transfers.Finish(t, err)
+		switch {
+		case errors.Is(err, fileshare.ErrExists):
+			b.notify(t, "Upload discarded: "+filename+" was taken while you were uploading.")
+		case errors.Is(err, errTooLarge):
+			os.Remove(partial)
+			b.notify(t, "Upload of "+filename+" discarded: it went over the upload limit of "+fileshare.FormatSize(maxUpload)+".")
+		case errors.Is(err, errQuota), errors.Is(err, errDiskFull):
+			os.Remove(partial)
+			b.notify(t, "Upload of "+filename+" discarded: "+b.spaceError(err)+".")
+		default:
+			b.logger.Printf("upload %s: %v", filename, err)
+			msg := outcome(t)
+			if info, serr := os.Stat(partial); serr == nil && info.Size() > 0 {
+				msg += " Use .upload -resume " + filename + " to continue from " + fileshare.FormatSize(info.Size()) + "."
+			}
+			b.notify(t, msg)
+		}
+	}()
+	// DCC SRECV = we (bot) want to RECEIVE; client connects and SENDS. SSEND would mean we send (wrong direction).
+	// Format: DCC SRECV <filename> <ip> <port> <resume_pos>: the client sends from resume_pos on. The
+	// filename is the one requested (no spaces); the name it will be stored under is in the reply.
+	ctcpUpload := "\x01DCC SRECV " + filename + " " + b.dccHost(host) + " " + strconv.Itoa(port) + " " + strconv.FormatInt(position, 10) + "\x01"
+	b.out.Privmsg(m.Nick, ctcpUpload)
+	if position > 0 {
+		b.reply(m, "Accept the DCC above to resume uploading "+stored+" from byte "+strconv.FormatInt(position, 10)+".")
+		return true
+	}
+	b.reply(m, "Accept the DCC above to upload as "+stored+" (your client will send the file).")
+	return true
+}
+
+// startReceiving marks partial as in use; it returns false if another upload is writing to it.
+func (b *Bot) startReceiving(partial string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.receiving[partial] {
+		return false
+	}
+	b.receiving[partial] = true
+	return true
+}
+
+func (b *Bot) stopReceiving(partial string) {
+	b.mu.Lock()
+	delete(b.receiving, partial)
+	b.mu.Unlock()
+}
+
+func (b *Bot) isReceiving(partial string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.receiving[partial]
+}
+
+// expirePartials removes partial uploads nobody has resumed within fileshare.PartialMaxAge.
+func (b *Bot) expirePartials() {
+	n, err := b.uploads.ExpirePartials(fileshare.PartialMaxAge, b.isReceiving)
+	if err != nil {
+		b.logger.Printf("expiring partial uploads: %v", err)
+	}
+	if n > 0 && b.debug {
+		b.logger.Printf("expired %d partial uploads", n)
+	}
+}
+
+// receive writes an upload into the hidden partial file from position on, syncs it and commits it
+// under name (or the name the conflict policy picks) only once r reports a clean end of stream, so
+// .list and .download never see an incomplete file. If the stream breaks, the partial file is kept
+// for .upload -resume. It returns the name the upload was stored under.
+func (b *Bot) receive(m *Message, name, partial string, position int64, r io.Reader) (string, error) {
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	if err = f.Truncate(position); err == nil {
+		_, err = f.Seek(position, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(f, r)
+	}
+	// Sync even after a broken stream: what was received is kept for resuming.
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(partial); err == nil {
+			err = b.checkSpace(m.Owner(), partial, info.Size(), 0)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	stored, err := b.uploads.Commit(partial, name, m.Owner())
+	if errors.Is(err, fileshare.ErrExists) {
+		os.Remove(partial)
+	}
+	return stored, err
+}
@@ -0,0 +1,158 @@
+package bot
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/irc"
+	"github.com/awgh/huzaa-bot/internal/irctest"
+	"github.com/awgh/huzaa-bot/internal/relaytest"
+	"github.com/awgh/huzaa-bot/internal/turnclient"
+)
+
+const botNick = "HuzaaBot"
+
+// startNetwork runs the bot against an in-process IRC server and relay and returns a connected
+// user client and the shared root.
+func startNetwork(t *testing.T) (*Bot, *irctest.Client, string) {
+	t.Helper()
+	ircd, err := irctest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ircd.Close() })
+	relay, err := relaytest.NewServer(&relaytest.Config{Users: map[string]string{"bot": "s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+	relayClient, err := turnclient.NewClient(relay.URL(), relay.TLSConfig(), "bot", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := irc.Connect(&irc.Config{Host: ircd.Host(), Port: ircd.Port(), Nick: botNick, Name: "test bot", Plaintext: true, NoFlood: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	irc.JoinChannel(conn, "#files")
+	out := irc.NewOutput(conn, &irc.OutputConfig{Rate: -1})
+	root := t.TempDir()
+	b := New(&Config{
+		Root:    root,
+		Channel: "#files",
+		Relay:   NewRelay(relayClient),
+		Sender:  out,
+		Logger:  log.New(io.Discard, "", 0),
+	})
+	b.Attach(conn)
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		out.Close()
+		b.Wait()
+	})
+	if err := ircd.WaitForMember("#files", botNick, 5*time.Second); err != nil {
+		t.Fatal("bot did not join:", err)
+	}
+
+	user, err := irctest.Dial(ircd.Addr(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { user.Close() })
+	return b, user, root
+}
+
+// ctcpPort returns the field at index (after the DCC verb) of a CTCP line as a port.
+func ctcpPort(t *testing.T, l *irctest.Line, index int) int {
+	t.Helper()
+	fields := strings.Fields(strings.Trim(l.Trailing(), "\x01"))
+	if len(fields) <= index+2 {
+		t.Fatalf("short DCC line %q", l.Raw)
+	}
+	port, err := strconv.Atoi(fields[index+2])
+	if err != nil {
+		t.Fatalf("bad port in %q", l.Raw)
+	}
+	return port
+}
+
+func TestIntegrationList(t *testing.T) {
+	_, user, root := startNetwork(t)
+	writeFile(t, filepath.Join(root, "report.pdf"), "pdf")
+
+	user.Privmsg(botNick, ".list")
+	if _, err := user.ExpectMessage("PRIVMSG", botNick, "report.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	// Commands in the channel are ignored.
+	user.Send("JOIN #files")
+	user.Privmsg("#files", ".help")
+	user.Privmsg(botNick, ".help")
+	l, err := user.Expect(func(l *irctest.Line) bool { return l.Nick() == botNick })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Params[0] != "alice" || !strings.Contains(l.Trailing(), ".download") {
+		t.Errorf("unexpected reply %q", l.Raw)
+	}
+}
+
+func TestIntegrationDownloadAndResume(t *testing.T) {
+	_, user, root := startNetwork(t)
+	content := strings.Repeat("0123456789", 1000)
+	writeFile(t, filepath.Join(root, "data.bin"), content)
+
+	user.Privmsg(botNick, ".download data.bin")
+	l, err := user.ExpectMessage("PRIVMSG", botNick, "\x01DCC SSEND data.bin ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := relaytest.Fetch(ctcpPort(t, l, 2))
+	if err != nil || string(got) != content {
+		t.Fatalf("download got %d bytes, %v", len(got), err)
+	}
+
+	user.Ctcp(botNick, "DCC RESUME data.bin 5000 9990")
+	l, err = user.ExpectMessage("NOTICE", botNick, "\x01DCC ACCEPT data.bin ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(l.Trailing(), " 9990\x01") {
+		t.Errorf("ACCEPT position: %q", l.Trailing())
+	}
+	got, err = relaytest.Fetch(ctcpPort(t, l, 1))
+	if err != nil || string(got) != "0123456789" {
+		t.Errorf("resume got %q, %v", got, err)
+	}
+	if _, err := user.ExpectMessage("PRIVMSG", botNick, "Resume accepted"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIntegrationUpload(t *testing.T) {
+	b, user, root := startNetwork(t)
+
+	user.Privmsg(botNick, ".upload notes.txt")
+	l, err := user.ExpectMessage("PRIVMSG", botNick, "\x01DCC SRECV notes.txt ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := relaytest.Send(ctcpPort(t, l, 2), []byte("from alice")); err != nil {
+		t.Fatal(err)
+	}
+	b.Wait()
+	data, err := os.ReadFile(filepath.Join(root, "notes.txt"))
+	if err != nil || string(data) != "from alice" {
+		t.Errorf("uploaded file = %q, %v", data, err)
+	}
+}
@@ -0,0 +1,134 @@
+package bot
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/fileshare"
+	"github.com/awgh/huzaa-bot/internal/transfer"
+	"github.com/awgh/huzaa-bot/internal/turnclient"
+)
+
+// finish ends t with err and tells its owner how it went.
+func (b *Bot) finish(t *transfer.Transfer, err error) {
+	b.transfers.Finish(t, err)
+	b.notify(t, outcome(t))
+}
+
+// notify messages t's owner under their current nick; nothing is sent if they have quit.
+func (b *Bot) notify(t *transfer.Transfer, text string) {
+	if nick := t.Nick(); nick != "" {
+		b.out.Privmsg(nick, text)
+	}
+}
+
+// outcome describes how a finished transfer ended: bytes, time and average rate if it completed,
+// otherwise why not. The relay does not confirm that a download reached the user's client, so a
+// finished download is only reported as handed to the relay.
+func outcome(t *transfer.Transfer) string {
+	what, done := "Download of "+t.File, " handed to the relay: "
+	if t.Direction == transfer.Upload {
+		what, done = "Upload of "+t.File, " complete: "
+	}
+	switch t.State() {
+	case transfer.Done:
+		d := t.Duration()
+		if d <= 0 {
+			return what + done + fileshare.FormatSize(t.Bytes()) + "."
+		}
+		return what + done + fileshare.FormatSize(t.Bytes()) + " in " + duration(d) + " (" + fileshare.FormatSize(int64(t.Rate())) + "/s)."
+	case transfer.Cancelled:
+		return what + " was cancelled" + after(t) + "."
+	}
+	return what + " failed" + after(t) + ": " + reason(t.Err()) + "."
+}
+
+// after returns " after <bytes>" if t transferred anything.
+func after(t *transfer.Transfer) string {
+	if t.Bytes() == 0 {
+		return ""
+	}
+	return " after " + fileshare.FormatSize(t.Bytes())
+}
+
+// reason turns a transfer error into something a user can act on. Errors from the bot's own disk
+// are not shown in detail (they would reveal paths); they are in the log.
+func reason(err error) string {
+	var relayErr turnclient.RelayError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return "unknown error"
+	case errors.Is(err, errNoData):
+		return "no data received; the DCC was not accepted or the client sent nothing"
+	case errors.Is(err, errTooLarge):
+		return errTooLarge.Error()
+	case errors.Is(err, errQuota):
+		return errQuota.Error()
+	case errors.Is(err, errDiskFull):
+		return errDiskFull.Error()
+	case errors.Is(err, turnclient.ErrAcceptTimeout):
+		return "your client did not connect in time"
+	case errors.Is(err, turnclient.ErrIdleTimeout):
+		return "the transfer stalled"
+	case errors.As(err, &relayErr):
+		return "the relay reported: " + string(relayErr)
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "the connection timed out"
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "the connection was lost"
+	}
+	return "an error on the bot's side"
+}
+
+// duration formats d for users: milliseconds under a second, whole seconds above.
+func duration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// cmdStatus handles ".status": progress, rate and ETA of the user's running transfers.
+func (b *Bot) cmdStatus(m *Message) {
+	n := 0
+	for _, t := range b.transfers.List() {
+		if t.Owner == m.Owner() {
+			b.reply(m, progress(t))
+			n++
+		}
+	}
+	if n == 0 {
+		b.reply(m, "You have no running transfers (.queue shows queued ones).")
+	}
+}
+
+// progress describes a running transfer: "#1a2b3c4d download of a.txt: 45% (4.5 MiB of 10 MiB) at
+// 1.2 MiB/s, about 5s left."
+func progress(t *transfer.Transfer) string {
+	s := "#" + t.Short() + " " + string(t.Direction) + " of " + t.File + ": "
+	if t.State() == transfer.Waiting {
+		return s + "waiting for your client to connect."
+	}
+	done := t.Offset + t.Bytes()
+	if t.Size > 0 {
+		s += strconv.FormatInt(done*100/t.Size, 10) + "% (" + fileshare.FormatSize(done) + " of " + fileshare.FormatSize(t.Size) + ")"
+	} else {
+		s += fileshare.FormatSize(done)
+	}
+	r := t.Rate()
+	if r <= 0 {
+		return s + "."
+	}
+	s += " at " + fileshare.FormatSize(int64(r)) + "/s"
+	if left := t.Remaining(); left >= 0 {
+		s += ", about " + duration(time.Duration(float64(left)/r*float64(time.Second))) + " left"
+	}
+	return s + "."
+}
@@ -0,0 +1,103 @@
+package bot
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/turnclient"
+)
+
+func TestCompletionMessages(t *testing.T) {
+	relay := &fakeRelay{uploadData: "uploaded"}
+	b, out, root := newTestBot(t, relay)
+	writeFile(t, filepath.Join(root, "a.txt"), "hello")
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download a.txt"})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload new.txt"})
+	b.Wait()
+	for _, want := range []string{"PRIVMSG alice :Download of a.txt handed to the relay: 5 B in ", "PRIVMSG alice :Upload of new.txt complete: 8 B in "} {
+		if !out.contains(want) {
+			t.Errorf("no %q in %q", want, out.all())
+		}
+	}
+
+	relay.uploadData = ""
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload other.txt"})
+	b.Wait()
+	if !out.contains("PRIVMSG alice :Upload of other.txt failed: no data received; ") {
+		t.Errorf("got %q", out.all())
+	}
+}
+
+func TestReason(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{io.ErrUnexpectedEOF, "the connection was lost"},
+		{turnclient.RelayError("peer gone"), "the relay reported: peer gone"},
+		{turnclient.ErrAcceptTimeout, "your client did not connect in time"},
+		{errors.Join(errors.New("read"), errQuota), "upload quota exceeded"},
+		{errors.New("open /srv/share/a.txt: input/output error"), "an error on the bot's side"},
+	} {
+		if got := reason(tc.err); got != tc.want {
+			t.Errorf("reason(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	b, out, _ := newTestBot(t, &fakeRelay{uploadStream: pr})
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".status"})
+	if !out.contains("PRIVMSG alice :You have no running transfers") {
+		t.Errorf("got %q", out.all())
+	}
+	b.HandleMessage(&Message{Nick: "alice", Ident: "a", Host: "h", Text: ".upload a.txt 10"})
+	b.HandleMessage(&Message{Nick: "alice", Ident: "a", Host: "h", Text: ".status"})
+	if !out.contains(" upload of a.txt: waiting for your client to connect.") {
+		t.Errorf("got %q", out.all())
+	}
+	pw.Write([]byte("abcd"))
+	list := b.Transfers().List()
+	for deadline := time.Now().Add(5 * time.Second); list[0].Bytes() < 4 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	b.HandleMessage(&Message{Nick: "alice", Ident: "a", Host: "h", Text: ".status"})
+	b.HandleMessage(&Message{Nick: "bob", Text: ".status"})
+	var line string
+	for _, l := range out.all() {
+		if strings.Contains(l, "40% (4 B of 10 B) at ") {
+			line = l
+		}
+	}
+	if !strings.HasPrefix(line, "PRIVMSG alice :#"+list[0].Short()+" upload of a.txt: ") || !strings.HasSuffix(line, " left.") {
+		t.Errorf("got %q", out.all())
+	}
+	if !out.contains("PRIVMSG bob :You have no running transfers") {
+		t.Errorf("bob sees alice's transfers: %q", out.all())
+	}
+
+	// The transfer follows alice to her new nick, and someone taking the old one learns nothing.
+	b.Transfers().Rename("alice", "alice_")
+	b.HandleMessage(&Message{Nick: "alice", Ident: "x", Host: "elsewhere", Text: ".status"})
+	if all := out.all(); !strings.HasPrefix(all[len(all)-1], "PRIVMSG alice :You have no running transfers") {
+		t.Errorf("new alice sees the transfer: %q", all)
+	}
+	b.HandleMessage(&Message{Nick: "alice_", Ident: "a", Host: "h", Text: ".status"})
+	if !out.contains("PRIVMSG alice_ :#" + list[0].Short() + " upload of a.txt: ") {
+		t.Errorf("renamed owner: %q", out.all())
+	}
+	pw.Close()
+	b.Wait()
+	if !out.contains("PRIVMSG alice_ :Upload of a.txt") || out.contains("PRIVMSG alice :Upload of a.txt") {
+		t.Errorf("outcome sent to the old nick: %q", out.all())
+	}
+}
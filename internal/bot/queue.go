@@ -0,0 +1,199 @@
+package bot
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// job is a transfer waiting for a slot.
+type job struct {
+	owner string
+	m     *Message // the request; Nick follows the sender's nick changes while queued (guarded by b.mu)
+	what  string   // "download of a.txt"
+	added time.Time
+	start func() bool // sets up the transfer; false if it failed and holds no slot
+	drop  func()      // releases what the job holds if it is removed without starting
+}
+
+// enqueue starts a transfer for m's sender now if a slot is free, or queues it until one is.
+// start sets up the transfer and returns true if it is running; the transfer calls release when it
+// ends.
+func (b *Bot) enqueue(m *Message, what string, start func() bool, drop func()) {
+	s := b.settings()
+	j := &job{owner: m.Owner(), m: m, what: what, added: time.Now(), start: start, drop: drop}
+	b.mu.Lock()
+	if b.free(j.owner, s) {
+		b.reserve(j.owner)
+		b.mu.Unlock()
+		if !start() {
+			b.release(j.owner)
+		}
+		return
+	}
+	queued := 0
+	for _, q := range b.queue {
+		if q.owner == j.owner {
+			queued++
+		}
+	}
+	if s.MaxQueuedPerUser > 0 && queued >= s.MaxQueuedPerUser {
+		b.mu.Unlock()
+		drop()
+		b.reply(m, "All transfer slots are busy and you already have "+strconv.Itoa(queued)+" requests queued; try again later.")
+		return
+	}
+	reply := *m // m belongs to the queue from here on
+	b.queue = append(b.queue, j)
+	pos := b.position(j)
+	b.mu.Unlock()
+	b.reply(&reply, "All transfer slots are busy; your "+what+" is #"+strconv.Itoa(pos)+" in the queue and starts automatically (.queue shows where you are).")
+}
+
+// free reports whether owner may start a transfer now. Callers hold b.mu.
+func (b *Bot) free(owner string, s *Settings) bool {
+	if s.MaxTransfers > 0 && b.running >= s.MaxTransfers {
+		return false
+	}
+	return s.MaxTransfersPerUser <= 0 || b.runningBy[owner] < s.MaxTransfersPerUser
+}
+
+// reserve takes a slot for owner. Callers hold b.mu.
+func (b *Bot) reserve(owner string) {
+	b.running++
+	b.runningBy[owner]++
+}
+
+// unreserve gives back owner's slot. Callers hold b.mu.
+func (b *Bot) unreserve(owner string) {
+	b.running--
+	if b.runningBy[owner]--; b.runningBy[owner] <= 0 {
+		delete(b.runningBy, owner)
+	}
+}
+
+// release frees owner's slot and starts queued transfers that now fit.
+func (b *Bot) release(owner string) {
+	b.mu.Lock()
+	b.unreserve(owner)
+	b.mu.Unlock()
+	b.dispatch()
+}
+
+// dispatch starts queued transfers while slots are free. Among the jobs that fit, the one whose
+// owner has the fewest running transfers goes first, then the oldest, so a user with a long queue
+// cannot keep everyone else waiting.
+func (b *Bot) dispatch() {
+	for {
+		s := b.settings()
+		b.mu.Lock()
+		best := -1
+		for i, j := range b.queue {
+			if b.free(j.owner, s) && (best < 0 || b.runningBy[j.owner] < b.runningBy[b.queue[best].owner]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			b.mu.Unlock()
+			return
+		}
+		j := b.queue[best]
+		b.queue = append(b.queue[:best], b.queue[best+1:]...)
+		b.reserve(j.owner)
+		nick := j.m.Nick
+		b.mu.Unlock()
+		b.out.Privmsg(nick, "A slot is free; starting your "+j.what+".")
+		if !j.start() {
+			b.mu.Lock()
+			b.unreserve(j.owner)
+			b.mu.Unlock()
+		}
+	}
+}
+
+// nickChanged follows a nick change from one nick to another in running transfers and queued
+// requests, so nothing is sent to whoever takes the old nick. to is "" when the user quit; their
+// queued requests are dropped.
+func (b *Bot) nickChanged(from, to string) {
+	b.transfers.Rename(from, to)
+	b.mu.Lock()
+	var dropped []*job
+	kept := b.queue[:0]
+	for _, j := range b.queue {
+		switch {
+		case !strings.EqualFold(j.m.Nick, from):
+			kept = append(kept, j)
+		case to == "":
+			dropped = append(dropped, j)
+		default:
+			j.m.Nick = to
+			kept = append(kept, j)
+		}
+	}
+	b.queue = kept
+	b.mu.Unlock()
+	for _, j := range dropped {
+		j.drop()
+	}
+}
+
+// position returns j's 1-based place in the queue. Callers hold b.mu.
+func (b *Bot) position(j *job) int {
+	for i, q := range b.queue {
+		if q == j {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// cmdQueue handles ".queue" (show your queued requests) and ".queue clear" (drop them).
+func (b *Bot) cmdQueue(m *Message, args []string) {
+	owner := m.Owner()
+	if len(args) == 1 && args[0] == "clear" {
+		b.mu.Lock()
+		var dropped []*job
+		kept := b.queue[:0]
+		for _, j := range b.queue {
+			if j.owner == owner {
+				dropped = append(dropped, j)
+			} else {
+				kept = append(kept, j)
+			}
+		}
+		b.queue = kept
+		b.mu.Unlock()
+		for _, j := range dropped {
+			j.drop()
+		}
+		b.reply(m, "Removed "+strconv.Itoa(len(dropped))+" queued requests.")
+		return
+	}
+	if len(args) != 0 {
+		b.reply(m, "Usage: .queue [clear]")
+		return
+	}
+	s := b.settings()
+	b.mu.Lock()
+	var lines []string
+	for i, j := range b.queue {
+		if j.owner == owner {
+			lines = append(lines, "#"+strconv.Itoa(i+1)+" of "+strconv.Itoa(len(b.queue))+": "+j.what+", waiting "+time.Since(j.added).Round(time.Second).String())
+		}
+	}
+	slots := strconv.Itoa(b.running) + " of "
+	if s.MaxTransfers > 0 {
+		slots += strconv.Itoa(s.MaxTransfers)
+	} else {
+		slots += "unlimited"
+	}
+	b.mu.Unlock()
+	if len(lines) == 0 {
+		b.reply(m, "You have nothing queued ("+slots+" slots in use).")
+		return
+	}
+	b.reply(m, strconv.Itoa(len(lines))+" queued ("+slots+" slots in use; .queue clear drops them):")
+	for _, l := range lines {
+		b.reply(m, l)
+	}
+}
@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitStarted waits until relay has registered n sessions.
+func waitStarted(t *testing.T, relay *fakeRelay, n int) []string {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if got := relay.started(); len(got) >= n {
+			return got
+		}
+	}
+	t.Fatalf("sessions %q, want %d", relay.started(), n)
+	return nil
+}
+
+// finishDownload lets the i'th held download complete.
+func finishDownload(relay *fakeRelay, i int) {
+	relay.mu.Lock()
+	close(relay.downloads[i].hold)
+	relay.mu.Unlock()
+}
+
+func TestQueue(t *testing.T) {
+	relay := &fakeRelay{hold: true}
+	b, out, root := newTestBot(t, relay)
+	for _, name := range []string{"a1", "a2", "a3", "b1"} {
+		writeFile(t, filepath.Join(root, name), name)
+	}
+	set(b, func(s *Settings) { s.MaxTransfers = 2; s.MaxQueuedPerUser = 1 })
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download a1"})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download a2"})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download a3"})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download a1"})
+	b.HandleMessage(&Message{Nick: "bob", Text: ".download b1"})
+	if got := relay.started(); len(got) != 2 {
+		t.Fatalf("started %q", got)
+	}
+	if !out.contains("PRIVMSG alice :All transfer slots are busy; your download of a3 is #1 in the queue") ||
+		!out.contains("PRIVMSG alice :All transfer slots are busy and you already have 1 requests queued") ||
+		!out.contains("PRIVMSG bob :All transfer slots are busy; your download of b1 is #2 in the queue") {
+		t.Errorf("got %q", out.all())
+	}
+	b.HandleMessage(&Message{Nick: "bob", Text: ".queue"})
+	if !out.contains("PRIVMSG bob :#2 of 2: download of b1, waiting ") || !out.contains("PRIVMSG bob :1 queued (2 of 2 slots in use") {
+		t.Errorf("got %q", out.all())
+	}
+
+	// Bob has nothing running, so he goes before alice's older request.
+	finishDownload(relay, 0)
+	if got := waitStarted(t, relay, 3); got[2] != "b1" {
+		t.Errorf("started %q, want b1 third", got)
+	}
+	finishDownload(relay, 1)
+	if got := waitStarted(t, relay, 4); got[3] != "a3" {
+		t.Errorf("started %q, want a3 fourth", got)
+	}
+	if !out.contains("PRIVMSG bob :A slot is free; starting your download of b1.") {
+		t.Errorf("got %q", out.all())
+	}
+	finishDownload(relay, 2)
+	finishDownload(relay, 3)
+	b.Wait()
+	if b.running != 0 || len(b.runningBy) != 0 {
+		t.Errorf("slots still held: %d %v", b.running, b.runningBy)
+	}
+}
+
+func TestQueuePerUser(t *testing.T) {
+	relay := &fakeRelay{hold: true}
+	b, out, root := newTestBot(t, relay)
+	writeFile(t, filepath.Join(root, "a"), "a")
+	set(b, func(s *Settings) { s.MaxTransfersPerUser = 1 })
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download a"})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download a"})
+	b.HandleMessage(&Message{Nick: "bob", Text: ".download a"})
+	if got := relay.started(); len(got) != 2 {
+		t.Fatalf("started %q", got)
+	}
+	b.HandleMessage(&Message{Nick: "alice", Text: ".queue clear"})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".queue"})
+	if !out.contains("PRIVMSG alice :Removed 1 queued requests.") || !out.contains("PRIVMSG alice :You have nothing queued (2 of unlimited slots in use).") {
+		t.Errorf("got %q", out.all())
+	}
+	finishDownload(relay, 0)
+	finishDownload(relay, 1)
+	b.Wait()
+	if got := relay.started(); len(got) != 2 || strings.Join(got, ",") != "a,a" {
+		t.Errorf("cleared request started anyway: %q", got)
+	}
+}
+
+func TestQueueFollowsNick(t *testing.T) {
+	relay := &fakeRelay{hold: true}
+	b, out, root := newTestBot(t, relay)
+	for _, name := range []string{"a1", "a2", "b1"} {
+		writeFile(t, filepath.Join(root, name), name)
+	}
+	set(b, func(s *Settings) { s.MaxTransfers = 1 })
+
+	b.HandleMessage(&Message{Nick: "alice", Ident: "a", Host: "h", Text: ".download a1"})
+	b.HandleMessage(&Message{Nick: "alice", Ident: "a", Host: "h", Text: ".download a2"})
+	b.HandleMessage(&Message{Nick: "bob", Ident: "b", Host: "h", Text: ".download b1"})
+	before := len(out.all())
+	b.nickChanged("Alice", "alice_")
+	b.nickChanged("bob", "") // quit: someone else may take the nick
+
+	finishDownload(relay, 0)
+	if got := waitStarted(t, relay, 2); got[1] != "a2" {
+		t.Errorf("started %q, want a2 second", got)
+	}
+	finishDownload(relay, 1)
+	b.Wait()
+	if !out.contains("PRIVMSG alice_ :A slot is free; starting your download of a2.") || !out.contains("PRIVMSG alice_ :\x01DCC SSEND a2 ") {
+		t.Errorf("queued request did not follow the nick: %q", out.all())
+	}
+	for _, l := range out.all()[before:] {
+		if strings.HasPrefix(l, "PRIVMSG alice :") || strings.HasPrefix(l, "PRIVMSG bob :") {
+			t.Errorf("sent to a stale nick: %q", l)
+		}
+	}
+	if got := relay.started(); len(got) != 2 {
+		t.Errorf("started %q; bob's request should have been dropped", got)
+	}
+}
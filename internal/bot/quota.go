@@ -0,0 +1,101 @@
+package bot
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/awgh/huzaa-bot/internal/fileshare"
+)
+
+// spaceCheckBytes is how often (in bytes received) an upload re-checks the quota and free space.
+const spaceCheckBytes = 1 << 20
+
+// spaceReader calls check with the bytes received so far before the first byte and every
+// spaceCheckBytes after, failing the upload as soon as check does.
+type spaceReader struct {
+	r       io.Reader
+	check   func(received int64) error
+	n, next int64
+}
+
+func (s *spaceReader) Read(p []byte) (int, error) {
+	if s.n >= s.next {
+		if err := s.check(s.n); err != nil {
+			return 0, err
+		}
+		s.next = s.n + spaceCheckBytes
+	}
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	return n, err
+}
+
+// checkSpace returns errQuota if owner's uploads would exceed the user quota once partial holds
+// size bytes, or errDiskFull if writing pending more bytes would leave less than the free-space
+// floor. Usage already counts partial at its current size.
+func (b *Bot) checkSpace(owner, partial string, size, pending int64) error {
+	s := b.settings()
+	if s.UserQuotaBytes > 0 {
+		used, err := b.uploads.Usage(owner)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(partial); err == nil {
+			used -= info.Size()
+		}
+		if used+size > s.UserQuotaBytes {
+			return errQuota
+		}
+	}
+	if s.MinFreeBytes > 0 {
+		free, err := b.freeSpace(b.root)
+		if err != nil {
+			return nil // unknown on this platform; the floor is not enforced
+		}
+		if free-pending < s.MinFreeBytes {
+			return errDiskFull
+		}
+	}
+	return nil
+}
+
+// spaceError turns a checkSpace error into a reply.
+func (b *Bot) spaceError(err error) string {
+	switch {
+	case errors.Is(err, errQuota):
+		return "over your upload quota of " + fileshare.FormatSize(b.settings().UserQuotaBytes) + " (see .quota)"
+	case errors.Is(err, errDiskFull):
+		return "not enough free disk space"
+	}
+	return err.Error()
+}
+
+// cmdQuota reports the user's upload usage and the space left.
+func (b *Bot) cmdQuota(m *Message) {
+	b.expirePartials()
+	used, err := b.uploads.Usage(m.Owner())
+	if err != nil {
+		b.reply(m, "Quota error: "+err.Error())
+		return
+	}
+	s := b.settings()
+	msg := "You have uploaded " + fileshare.FormatSize(used)
+	if s.UserQuotaBytes > 0 {
+		left := s.UserQuotaBytes - used
+		if left < 0 {
+			left = 0
+		}
+		msg += " of your " + fileshare.FormatSize(s.UserQuotaBytes) + " quota; " + fileshare.FormatSize(left) + " left."
+	} else {
+		msg += "; there is no per-user quota."
+	}
+	if free, err := b.freeSpace(b.root); err == nil {
+		avail := free - s.MinFreeBytes
+		if avail < 0 {
+			avail = 0
+		}
+		msg += " Space available for uploads: " + fileshare.FormatSize(avail) + "."
+	}
+	b.reply(m, msg)
+}
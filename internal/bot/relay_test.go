@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/awgh/huzaa-bot/internal/fileshare"
+	"github.com/awgh/huzaa-bot/internal/relaytest"
+	"github.com/awgh/huzaa-bot/internal/turnclient"
+)
+
+// newRelayBot returns a bot wired to an in-process relay configured by cfg, with user "bot".
+func newRelayBot(t *testing.T, cfg relaytest.Config) (*Bot, *fakeSender, string) {
+	t.Helper()
+	cfg.Users = map[string]string{"bot": "s3cret"}
+	srv, err := relaytest.NewServer(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	client, err := turnclient.NewClient(srv.URL(), srv.TLSConfig(), "bot", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	out := &fakeSender{}
+	b := New(&Config{
+		Root:    root,
+		Channel: "#files",
+		Relay:   NewRelay(client),
+		Sender:  out,
+		Logger:  log.New(io.Discard, "", 0),
+	})
+	return b, out, root
+}
+
+// dccPort returns the port field of the first line sent containing prefix (e.g. "\x01DCC SSEND ").
+// index is the position of the port among the space-separated fields after prefix.
+func dccPort(t *testing.T, out *fakeSender, prefix string, index int) int {
+	t.Helper()
+	for _, l := range out.all() {
+		i := strings.Index(l, prefix)
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(strings.Trim(l[i+len(prefix):], "\x01"))
+		if len(fields) <= index {
+			break
+		}
+		port, err := strconv.Atoi(fields[index])
+		if err != nil {
+			t.Fatalf("bad port in %q", l)
+		}
+		return port
+	}
+	t.Fatalf("no %q line in %q", prefix, out.all())
+	return 0
+}
+
+func TestRelayDownload(t *testing.T) {
+	b, out, root := newRelayBot(t, relaytest.Config{})
+	content := strings.Repeat("relay download ", 5000)
+	writeFile(t, filepath.Join(root, "big.txt"), content)
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download big.txt"})
+	got, err := relaytest.Fetch(dccPort(t, out, "\x01DCC SSEND big.txt ", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Wait()
+	if string(got) != content {
+		t.Errorf("received %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestRelayResume(t *testing.T) {
+	b, out, root := newRelayBot(t, relaytest.Config{})
+	writeFile(t, filepath.Join(root, "a.txt"), "0123456789")
+
+	b.HandleCTCP("DCC", &Message{Nick: "alice", Text: "RESUME a.txt 5000 4"})
+	got, err := relaytest.Fetch(dccPort(t, out, "\x01DCC ACCEPT a.txt ", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Wait()
+	if string(got) != "456789" {
+		t.Errorf("resumed data = %q", got)
+	}
+}
+
+func TestRelayUpload(t *testing.T) {
+	b, out, root := newRelayBot(t, relaytest.Config{})
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload up.txt"})
+	if err := relaytest.Send(dccPort(t, out, "\x01DCC SRECV up.txt ", 1), []byte("via relay")); err != nil {
+		t.Fatal(err)
+	}
+	b.Wait()
+	data, err := os.ReadFile(filepath.Join(root, "up.txt"))
+	if err != nil || string(data) != "via relay" {
+		t.Errorf("uploaded file = %q, %v", data, err)
+	}
+}
+
+func TestRelayUploadDropped(t *testing.T) {
+	b, out, root := newRelayBot(t, relaytest.Config{DropUploads: true})
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".upload up.txt"})
+	if err := relaytest.Send(dccPort(t, out, "\x01DCC SRECV up.txt ", 1), []byte("cut short")); err != nil {
+		t.Fatal(err)
+	}
+	b.Wait()
+	if entries, err := fileshare.ListDir(root, "", ""); err != nil || len(entries) != 0 {
+		t.Errorf("aborted upload is visible: %v (%v)", entries, err)
+	}
+	if !out.contains("failed after 9 B: the connection was lost. Use .upload -resume up.txt") {
+		t.Errorf("got %q", out.all())
+	}
+}
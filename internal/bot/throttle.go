@@ -0,0 +1,62 @@
+package bot
+
+import (
+	"math"
+
+	"github.com/awgh/huzaa-bot/internal/ratelimit"
+)
+
+// userLimiter is a per-user bandwidth limiter shared by that user's running transfers.
+type userLimiter struct {
+	lim *ratelimit.Limiter
+	n   int // running transfers using it
+}
+
+// newLimiter returns a limiter for rate bytes per second (<= 0: unlimited) with a one-second burst.
+func newLimiter(rate int64) *ratelimit.Limiter {
+	return ratelimit.New(float64(rate), burst(rate))
+}
+
+func burst(rate int64) int {
+	if rate > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(rate)
+}
+
+// limiters returns the limiters a new transfer for owner waits on: the global one, owner's and its
+// own. Call done when the transfer ends.
+func (b *Bot) limiters(owner string) (lims []*ratelimit.Limiter, done func()) {
+	s := b.settings()
+	own := newLimiter(s.TransferBandwidthBytes)
+	b.mu.Lock()
+	u := b.userLims[owner]
+	if u == nil {
+		u = &userLimiter{lim: newLimiter(s.UserBandwidthBytes)}
+		b.userLims[owner] = u
+	}
+	u.n++
+	b.transferLims[own] = true
+	b.mu.Unlock()
+	return []*ratelimit.Limiter{b.global, u.lim, own}, func() {
+		b.mu.Lock()
+		delete(b.transferLims, own)
+		if u.n--; u.n == 0 {
+			delete(b.userLims, owner)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// setRates applies s's bandwidth limits, including to running transfers.
+func (b *Bot) setRates(s *Settings) {
+	b.global.SetRate(float64(s.BandwidthBytes), burst(s.BandwidthBytes))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, u := range b.userLims {
+		u.lim.SetRate(float64(s.UserBandwidthBytes), burst(s.UserBandwidthBytes))
+	}
+	for lim := range b.transferLims {
+		lim.SetRate(float64(s.TransferBandwidthBytes), burst(s.TransferBandwidthBytes))
+	}
+}
@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBandwidth(t *testing.T) {
+	relay := &fakeRelay{hold: true}
+	b, out := newAdminBot(t, relay)
+	writeFile(t, filepath.Join(b.root, "a.txt"), "a")
+	set(b, func(s *Settings) { s.BandwidthBytes, s.UserBandwidthBytes, s.TransferBandwidthBytes = 1000, 500, 100 })
+
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download a.txt"})
+	b.HandleMessage(&Message{Nick: "alice", Text: ".download a.txt"})
+	relay.mu.Lock()
+	d1, d2 := relay.downloads[0], relay.downloads[1]
+	relay.mu.Unlock()
+	rates := func(d *fakeDownload) []float64 {
+		var r []float64
+		for _, l := range d.limiters {
+			r = append(r, l.Rate())
+		}
+		return r
+	}
+	if got := rates(d1); len(got) != 3 || got[0] != 1000 || got[1] != 500 || got[2] != 100 {
+		t.Fatalf("limiter rates %v", got)
+	}
+	if d1.limiters[0] != d2.limiters[0] || d1.limiters[1] != d2.limiters[1] || d1.limiters[2] == d2.limiters[2] {
+		t.Error("global and user limiters should be shared, transfer limiters not")
+	}
+
+	// Changes apply to running transfers.
+	admin(b, ".bandwidth transfer 2K")
+	admin(b, ".bandwidth user 0")
+	admin(b, ".bandwidth")
+	if got := rates(d2); got[1] != 0 || got[2] != 2048 {
+		t.Errorf("limiter rates after .bandwidth %v", got)
+	}
+	if !out.contains("PRIVMSG root :The transfer bandwidth limit is now 2.0 KiB/s.") ||
+		!out.contains("PRIVMSG root :Bandwidth: 1000 B/s in total, unlimited per user, 2.0 KiB/s per transfer.") {
+		t.Errorf("got %q", out.all())
+	}
+	admin(b, ".bandwidth all 1M")
+	if !out.contains("PRIVMSG root :Usage: .bandwidth") {
+		t.Errorf("got %q", out.all())
+	}
+
+	finishDownload(relay, 0)
+	finishDownload(relay, 1)
+	b.Wait()
+	if len(b.userLims) != 0 || len(b.transferLims) != 0 {
+		t.Errorf("limiters left after transfers ended: %v %v", b.userLims, b.transferLims)
+	}
+}
@@ -2,13 +2,18 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/awgh/huzaa-bot/internal/acl"
 )
 
 // FileshareConfig is the IRC + fileshare config (Marvin-compatible subset + relay).
 type FileshareConfig struct {
+	// Network names this config in logs; defaults to the config file name without .json.
+	Network      string `json:"Network,omitempty"`
 	Host         string `json:"Host"`
 	Port         string `json:"Port"`
 	Nick         string `json:"Nick"`
@@ -20,13 +25,73 @@ type FileshareConfig struct {
 	ProxyEnabled bool   `json:"ProxyEnabled"`
 	Proxy        string `json:"Proxy"`
 	SASL         bool   `json:"SASL"`
-	SlackAPIToken string `json:"SlackAPIToken,omitempty"`
-	SharedDir    string `json:"SharedDir"`
-	RelayTURNURL string `json:"RelayTURNURL"`
+	// SASLMechanism is PLAIN (default) or EXTERNAL; used when SASL is true.
+	SASLMechanism  string `json:"SASLMechanism,omitempty"`
+	SASLAccount    string `json:"SASLAccount,omitempty"`
+	SASLPassword   string `json:"SASLPassword,omitempty"`
+	ClientCertFile string `json:"ClientCertFile,omitempty"`
+	ClientKeyFile  string `json:"ClientKeyFile,omitempty"`
+	// Plaintext connects to IRC without TLS; only allowed for loopback hosts.
+	Plaintext         bool   `json:"Plaintext,omitempty"`
+	TLSSkipVerify     bool   `json:"TLSSkipVerify,omitempty"`
+	TLSCAFile         string `json:"TLSCAFile,omitempty"`
+	TLSFingerprint    string `json:"TLSFingerprint,omitempty"`
+	SlackAPIToken     string `json:"SlackAPIToken,omitempty"`
+	SharedDir         string `json:"SharedDir"`
+	RelayTURNURL      string `json:"RelayTURNURL"`
 	RelayAuthUsername string `json:"RelayAuthUsername,omitempty"`
 	RelayAuthSecret   string `json:"RelayAuthSecret,omitempty"`
-	MaxUploadBytes int64 `json:"MaxUploadBytes,omitempty"`
-	MaxFileBytes   int64 `json:"MaxFileBytes,omitempty"`
+	// RelayLegacyAuth allows sending the raw secret to relays without challenge-response auth.
+	RelayLegacyAuth bool `json:"RelayLegacyAuth,omitempty"`
+	// RelayTURNURLs are further relays, tried after RelayTURNURL (which may be left empty) in the
+	// order RelaySelection gives: priority (default) or round-robin. RelayHealthInterval is how
+	// often, in seconds, the relays are checked when there are several (default 60; negative: never).
+	RelayTURNURLs       []string `json:"RelayTURNURLs,omitempty"`
+	RelaySelection      string   `json:"RelaySelection,omitempty"`
+	RelayHealthInterval float64  `json:"RelayHealthInterval,omitempty"`
+	// RelayCAFile, RelayFingerprints and RelaySPKIPins control relay certificate verification
+	// (see tlsutil.Options); RelayCertFile/RelayKeyFile are an optional client certificate for mutual TLS.
+	RelayCAFile       string   `json:"RelayCAFile,omitempty"`
+	RelayFingerprints []string `json:"RelayFingerprints,omitempty"`
+	RelaySPKIPins     []string `json:"RelaySPKIPins,omitempty"`
+	RelayCertFile     string   `json:"RelayCertFile,omitempty"`
+	RelayKeyFile      string   `json:"RelayKeyFile,omitempty"`
+	MaxUploadBytes    int64    `json:"MaxUploadBytes,omitempty"`
+	MaxFileBytes      int64    `json:"MaxFileBytes,omitempty"`
+	// RelayDialTimeout, RelayAcceptTimeout and RelayIdleTimeout are in seconds; see
+	// turnclient.Client for their meaning and defaults (0: default, negative: no timeout).
+	RelayDialTimeout   float64 `json:"RelayDialTimeout,omitempty"`
+	RelayAcceptTimeout float64 `json:"RelayAcceptTimeout,omitempty"`
+	RelayIdleTimeout   float64 `json:"RelayIdleTimeout,omitempty"`
+	// SendRate (lines per second, default 2; negative disables pacing) and SendBurst (default 5)
+	// pace the bot's replies so it is not killed for flooding.
+	SendRate  float64 `json:"SendRate,omitempty"`
+	SendBurst int     `json:"SendBurst,omitempty"`
+	// UploadConflict is what happens when an upload's name is taken: reject (default), rename,
+	// version or owner (see fileshare.Conflict*).
+	UploadConflict string `json:"UploadConflict,omitempty"`
+	// UserQuotaBytes caps each user's total uploads; MinFreeBytes is the free space uploads must
+	// leave on the SharedDir filesystem. 0 disables either.
+	UserQuotaBytes int64 `json:"UserQuotaBytes,omitempty"`
+	MinFreeBytes   int64 `json:"MinFreeBytes,omitempty"`
+	// ACL rules grant list, download, upload and admin by hostmask, services account, channel
+	// status and directory. Without rules everyone may list, download and upload.
+	ACL []acl.Rule `json:"ACL,omitempty"`
+	// Bans are nick!ident@host masks whose commands are ignored, in addition to those made with .ban.
+	Bans []string `json:"Bans,omitempty"`
+	// MaxTransfers and MaxTransfersPerUser limit running transfers (0: unlimited); further requests
+	// wait in a queue, of which each user may hold MaxQueuedPerUser (0: unlimited).
+	MaxTransfers        int `json:"MaxTransfers,omitempty"`
+	MaxTransfersPerUser int `json:"MaxTransfersPerUser,omitempty"`
+	MaxQueuedPerUser    int `json:"MaxQueuedPerUser,omitempty"`
+	// BandwidthBytes, UserBandwidthBytes and TransferBandwidthBytes cap relay throughput in bytes per
+	// second across all transfers, per user and per transfer (0: unlimited).
+	BandwidthBytes         int64 `json:"BandwidthBytes,omitempty"`
+	UserBandwidthBytes     int64 `json:"UserBandwidthBytes,omitempty"`
+	TransferBandwidthBytes int64 `json:"TransferBandwidthBytes,omitempty"`
+
+	// Path is the file the config was loaded from, for .reload.
+	Path string `json:"-"`
 }
 
 // LoadFileshareConfigs loads all *.json files from dir and returns valid fileshare configs (skips Slack).
@@ -40,22 +105,44 @@ func LoadFileshareConfigs(dir string) ([]*FileshareConfig, error) {
 		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
 			continue
 		}
-		path := filepath.Join(dir, e.Name())
-		data, err := os.ReadFile(path)
+		c, err := LoadFileshareConfig(filepath.Join(dir, e.Name()))
 		if err != nil {
 			continue
 		}
-		var c FileshareConfig
-		if err := json.Unmarshal(data, &c); err != nil {
-			continue
-		}
-		if c.SlackAPIToken != "" {
-			continue
-		}
-		if c.Host == "" || c.SharedDir == "" || c.RelayTURNURL == "" {
-			continue
-		}
-		configs = append(configs, &c)
+		configs = append(configs, c)
 	}
 	return configs, nil
 }
+
+// RelayURLs returns RelayTURNURL, if set, followed by RelayTURNURLs.
+func (c *FileshareConfig) RelayURLs() []string {
+	var urls []string
+	if c.RelayTURNURL != "" {
+		urls = append(urls, c.RelayTURNURL)
+	}
+	return append(urls, c.RelayTURNURLs...)
+}
+
+// LoadFileshareConfig loads one fileshare config. It fails if the file cannot be read or parsed,
+// is a Slack config or lacks Host, SharedDir or a relay.
+func LoadFileshareConfig(path string) (*FileshareConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c FileshareConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if c.SlackAPIToken != "" {
+		return nil, errors.New(path + ": Slack config")
+	}
+	if c.Host == "" || c.SharedDir == "" || len(c.RelayURLs()) == 0 {
+		return nil, errors.New(path + ": Host, SharedDir and RelayTURNURL (or RelayTURNURLs) are required")
+	}
+	if c.Network == "" {
+		c.Network = strings.TrimSuffix(filepath.Base(path), ".json")
+	}
+	c.Path = path
+	return &c, nil
+}
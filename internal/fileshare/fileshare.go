@@ -2,9 +2,16 @@ package fileshare
 
 import (
 	"errors"
+	"fmt"
 	"io/fs"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // SafePath resolves userInput relative to root and returns a path under root.
@@ -27,40 +34,267 @@ func SafePath(root, userInput string) (string, error) {
 		return "", err
 	}
 	rootAbs = filepath.Clean(rootAbs)
-	rel, err := filepath.Rel(rootAbs, abs)
+	if !within(rootAbs, abs) {
+		return "", errors.New("path escapes root")
+	}
+	// Resolve symlinks on the longest existing prefix (the file itself may not exist yet for uploads).
+	realRoot, err := filepath.EvalSymlinks(rootAbs)
 	if err != nil {
 		return "", err
 	}
-	if rel == ".." || len(rel) >= 3 && rel[:3] == ".."+string(filepath.Separator) {
-		return "", errors.New("path escapes root")
+	existing := abs
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if !within(realRoot, real) {
+				return "", errors.New("path escapes root")
+			}
+			break
+		}
+		if existing == rootAbs {
+			break
+		}
+		existing = filepath.Dir(existing)
 	}
 	return abs, nil
 }
 
-// ListDir lists entries under root (optionally matching pattern). Only returns paths under root.
-func ListDir(root, pattern string) ([]fs.DirEntry, error) {
+// within reports whether path is root or below it. Both must be absolute and clean.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// IsHidden reports whether any segment of the slash- or OS-separated relative path starts with a
+// dot. Hidden files (such as in-progress uploads) are never listed or served.
+func IsHidden(rel string) bool {
+	for _, seg := range strings.FieldsFunc(filepath.ToSlash(rel), func(r rune) bool { return r == '/' }) {
+		if strings.HasPrefix(seg, ".") && seg != "." && seg != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Entry is a file or directory found by ListDir or Glob.
+type Entry struct {
+	Path    string // slash-separated, relative to root
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// Name returns Path with a trailing slash for directories.
+func (e Entry) Name() string {
+	if e.IsDir {
+		return e.Path + "/"
+	}
+	return e.Path
+}
+
+func newEntry(rel string, info fs.FileInfo) Entry {
+	return Entry{Path: filepath.ToSlash(rel), IsDir: info.IsDir(), Size: info.Size(), ModTime: info.ModTime()}
+}
+
+// ListDir lists entries of dir (relative to root, "" for root itself), optionally matching pattern
+// against the entry name. Only returns paths under root; hidden entries are skipped.
+func ListDir(root, dir, pattern string) ([]Entry, error) {
 	rootAbs, err := filepath.Abs(root)
 	if err != nil {
 		return nil, err
 	}
 	rootAbs = filepath.Clean(rootAbs)
-	var out []fs.DirEntry
-	entries, err := os.ReadDir(rootAbs)
+	dirAbs := rootAbs
+	if dir != "" && filepath.Clean(dir) != "." {
+		if IsHidden(dir) {
+			return nil, fs.ErrNotExist
+		}
+		if dirAbs, err = SafePath(rootAbs, dir); err != nil {
+			return nil, err
+		}
+	}
+	var out []Entry
+	entries, err := os.ReadDir(dirAbs)
 	if err != nil {
 		return nil, err
 	}
 	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
 		if pattern != "" {
 			ok, _ := filepath.Match(pattern, e.Name())
 			if !ok {
 				continue
 			}
 		}
-		out = append(out, e)
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(rootAbs, filepath.Join(dirAbs, e.Name()))
+		if err != nil {
+			continue
+		}
+		out = append(out, newEntry(rel, info))
 	}
 	return out, nil
 }
 
+// Sort orders accepted by SortEntries.
+const (
+	SortName = "name"
+	SortSize = "size" // largest first
+	SortDate = "date" // newest first
+)
+
+// SortEntries sorts entries in place by one of SortName, SortSize or SortDate. Ties fall back to
+// the path so listings are stable across pages.
+func SortEntries(entries []Entry, by string) error {
+	var less func(a, b Entry) bool
+	switch by {
+	case SortName, "":
+		less = func(a, b Entry) bool { return false }
+	case SortSize:
+		less = func(a, b Entry) bool { return a.Size > b.Size }
+	case SortDate:
+		less = func(a, b Entry) bool { return a.ModTime.After(b.ModTime) }
+	default:
+		return fmt.Errorf("unknown sort order %q", by)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.Path < b.Path
+	})
+	return nil
+}
+
+// FormatSize formats n bytes as a short human-readable size ("512 B", "1.5 KiB", "20 MiB").
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+	v := float64(n) / float64(div)
+	if v >= 10 {
+		return fmt.Sprintf("%.0f %ciB", v, "KMGTPE"[exp])
+	}
+	return fmt.Sprintf("%.1f %ciB", v, "KMGTPE"[exp])
+}
+
+// ParseSize parses a byte count: a number with an optional binary unit, as in "512", "64K",
+// "1.5M", "2 GiB" (K/M/G/T, optionally followed by "iB" or "B"; case-insensitive).
+func ParseSize(s string) (int64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	t = strings.TrimSuffix(strings.TrimSuffix(t, "B"), "I")
+	mult := int64(1)
+	if i := strings.IndexAny(t, "KMGT"); i >= 0 && i == len(t)-1 {
+		mult = 1 << (10 * (strings.IndexByte("KMGT", t[i]) + 1))
+		t = t[:i]
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+	if err != nil || !(v >= 0) || v*float64(mult) >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// MaxGlobResults bounds the number of entries Glob returns.
+const MaxGlobResults = 1000
+
+// Glob returns entries under root whose slash-separated relative path matches pattern. Besides the
+// filepath.Match syntax within a path segment, a "**" segment matches zero or more directories
+// ("**/*.pdf", "docs/**/draft-*"). Symlinked directories are not followed and hidden entries are skipped.
+func Glob(root, pattern string) ([]Entry, error) {
+	rootAbs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	rootAbs = filepath.Clean(rootAbs)
+	pattern = strings.Trim(pattern, "/")
+	if pattern == "" {
+		return nil, errors.New("empty pattern")
+	}
+	var segs []string
+	for _, seg := range strings.Split(pattern, "/") {
+		if seg == "**" && len(segs) > 0 && segs[len(segs)-1] == "**" {
+			continue // "**/**" is the same as "**"
+		}
+		segs = append(segs, seg)
+		if seg == ".." {
+			return nil, errors.New("path not local")
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, err
+		}
+	}
+	var out []Entry
+	err = filepath.WalkDir(rootAbs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // skip unreadable entries
+		}
+		if p == rootAbs {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(rootAbs, p)
+		if err != nil {
+			return nil
+		}
+		if matchSegments(segs, strings.Split(filepath.ToSlash(rel), "/")) {
+			if info, err := d.Info(); err == nil {
+				out = append(out, newEntry(rel, info))
+			}
+			if len(out) >= MaxGlobResults {
+				return fs.SkipAll
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+// matchSegments matches path segments against pattern segments, where "**" matches any number of
+// segments. It works in O(len(pattern)*len(name)) so patterns with many "**" cannot blow up.
+func matchSegments(pattern, name []string) bool {
+	// ok[j] reports whether the pattern so far matches name[:j].
+	ok := make([]bool, len(name)+1)
+	ok[0] = true
+	for _, seg := range pattern {
+		if seg == "**" {
+			for j := 1; j <= len(name); j++ {
+				ok[j] = ok[j] || ok[j-1]
+			}
+			continue
+		}
+		for j := len(name); j > 0; j-- {
+			m, _ := path.Match(seg, name[j-1])
+			ok[j] = ok[j-1] && m
+		}
+		ok[0] = false
+	}
+	return ok[len(name)]
+}
+
 // ResolveRoot returns the absolute canonical root path and ensures it exists.
 func ResolveRoot(dir string) (string, error) {
 	abs, err := filepath.Abs(dir)
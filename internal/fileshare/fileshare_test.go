@@ -3,7 +3,9 @@ package fileshare
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSafePath(t *testing.T) {
@@ -45,3 +47,204 @@ func TestSafePath(t *testing.T) {
 		}
 	})
 }
+
+func TestSafePathSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if _, err := SafePath(root, "link/secret.txt"); err == nil {
+		t.Error("expected error for path through symlink outside root")
+	}
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SafePath(root, "sub/new/file.txt"); err != nil {
+		t.Errorf("non-existent path under root rejected: %v", err)
+	}
+}
+
+// makeTree creates files (and their parent directories) under a new temp root.
+func makeTree(t *testing.T, files ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, f := range files {
+		p := filepath.Join(root, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func names(entries []Entry) []string {
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.Name())
+	}
+	return out
+}
+
+func TestListDir(t *testing.T) {
+	root := makeTree(t, "a.txt", "docs/b.pdf", "docs/c.txt", "docs/deep/d.pdf", ".a.txt.part", ".hidden/e.pdf")
+
+	entries, err := ListDir(root, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(names(entries), ","); got != "a.txt,docs/" {
+		t.Errorf("root listing = %s", got)
+	}
+	entries, err = ListDir(root, "docs/", "*.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(names(entries), ","); got != "docs/b.pdf" {
+		t.Errorf("docs/*.pdf = %s", got)
+	}
+	if entries[0].Size != int64(len("docs/b.pdf")) {
+		t.Errorf("size = %d", entries[0].Size)
+	}
+	if _, err := ListDir(root, "../", ""); err == nil {
+		t.Error("expected error listing outside root")
+	}
+	if _, err := ListDir(root, ".hidden", ""); err == nil {
+		t.Error("expected error listing hidden directory")
+	}
+}
+
+func TestGlob(t *testing.T) {
+	root := makeTree(t, "a.pdf", "docs/b.pdf", "docs/c.txt", "docs/deep/d.pdf", "other/e.pdf", ".hidden/f.pdf", "docs/.g.pdf")
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"**/*.pdf", "a.pdf,docs/b.pdf,docs/deep/d.pdf,other/e.pdf"},
+		{"docs/**/*.pdf", "docs/b.pdf,docs/deep/d.pdf"},
+		{"**/deep", "docs/deep/"},
+		{"*.pdf", "a.pdf"},
+		{"**/*.zip", ""},
+		{"**/**/docs/**/**/*.pdf", "docs/b.pdf,docs/deep/d.pdf"},
+		{"**/deep/**", "docs/deep/,docs/deep/d.pdf"},
+	}
+	for _, tt := range tests {
+		entries, err := Glob(root, tt.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.pattern, err)
+		}
+		if got := strings.Join(names(entries), ","); got != tt.want {
+			t.Errorf("Glob(%q) = %s, want %s", tt.pattern, got, tt.want)
+		}
+	}
+	if _, err := Glob(root, "../**"); err == nil {
+		t.Error("expected error for pattern escaping root")
+	}
+}
+
+func TestMatchSegmentsManyStars(t *testing.T) {
+	// Each "**" used to multiply the work by the path depth.
+	pattern := strings.Split(strings.Repeat("**/*/", 60)+"x", "/")
+	name := strings.Split("a/b/c/d/e/f/g/h", "/")
+	start := time.Now()
+	if matchSegments(pattern, name) {
+		t.Error("matched a path shorter than the pattern")
+	}
+	if !matchSegments([]string{"**", "*", "**", "h"}, name) {
+		t.Error("no match")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("took %v", d)
+	}
+}
+
+func TestIsHidden(t *testing.T) {
+	for name, want := range map[string]bool{
+		"a.txt":          false,
+		"docs/a.txt":     false,
+		"./a.txt":        false,
+		".a.txt.part":    true,
+		"docs/.a.txt":    true,
+		".hidden/a.txt":  true,
+		"../escape.txt":  false,
+		"docs/..foo/bar": true,
+	} {
+		if got := IsHidden(name); got != want {
+			t.Errorf("IsHidden(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSortEntries(t *testing.T) {
+	now := time.Now()
+	entries := []Entry{
+		{Path: "b", Size: 10, ModTime: now.Add(-time.Hour)},
+		{Path: "a", Size: 10, ModTime: now},
+		{Path: "c", Size: 30, ModTime: now.Add(-2 * time.Hour)},
+	}
+	tests := []struct {
+		by   string
+		want string
+	}{
+		{SortName, "a,b,c"},
+		{SortSize, "c,a,b"},
+		{SortDate, "a,b,c"},
+	}
+	for _, tt := range tests {
+		if err := SortEntries(entries, tt.by); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(names(entries), ","); got != tt.want {
+			t.Errorf("sort by %s = %s, want %s", tt.by, got, tt.want)
+		}
+	}
+	if err := SortEntries(entries, "colour"); err == nil {
+		t.Error("expected error for unknown sort order")
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{20 * 1024 * 1024, "20 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := FormatSize(tt.n); got != tt.want {
+			t.Errorf("FormatSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512B", 512},
+		{"64k", 64 << 10},
+		{"1.5M", 3 << 19},
+		{"2 GiB", 2 << 30},
+		{"1T", 1 << 40},
+	}
+	for _, tt := range tests {
+		if got, err := ParseSize(tt.s); err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", tt.s, got, err, tt.want)
+		}
+	}
+	for _, s := range []string{"", "B", "-1", "1X", "NaN", "Inf", "1e30"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) succeeded", s)
+		}
+	}
+}
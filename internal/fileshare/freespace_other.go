@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package fileshare
+
+import "errors"
+
+// FreeSpace is not implemented on this platform; the free-space floor is not enforced.
+func FreeSpace(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
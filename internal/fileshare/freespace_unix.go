@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package fileshare
+
+import "syscall"
+
+// FreeSpace returns the bytes available to unprivileged users on the filesystem holding path.
+func FreeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
@@ -0,0 +1,291 @@
+package fileshare
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upload conflict policies: what happens when an upload's name is already taken.
+const (
+	ConflictReject  = "reject"  // refuse the upload
+	ConflictRename  = "rename"  // store as "name-1.ext", "name-2.ext", ... (no spaces, so DCC can carry it)
+	ConflictVersion = "version" // move the old file to VersionsDir, then replace it
+	ConflictOwner   = "owner"   // replace only if the uploader uploaded the existing file
+)
+
+// VersionsDir is the hidden directory under the root that keeps replaced files for ConflictVersion.
+const VersionsDir = ".versions"
+
+// PartialMaxAge is how long an unfinished upload is kept for resuming after it was last written to;
+// see ExpirePartials.
+const PartialMaxAge = 7 * 24 * time.Hour
+
+// ownersFile is the hidden index of who uploaded each file, relative to the root.
+const ownersFile = ".owners.json"
+
+// ErrExists is returned when an upload name is taken and the conflict policy does not allow
+// replacing it.
+var ErrExists = errors.New("file already exists")
+
+// Uploads places completed uploads in a shared root according to a conflict policy and records who
+// uploaded each file. It is safe for concurrent use.
+type Uploads struct {
+	root   string
+	policy string
+	mu     sync.Mutex
+}
+
+// NewUploads returns Uploads for root. policy is one of the Conflict constants; "" means ConflictReject.
+func NewUploads(root, policy string) (*Uploads, error) {
+	switch policy {
+	case "":
+		policy = ConflictReject
+	case ConflictReject, ConflictRename, ConflictVersion, ConflictOwner:
+	default:
+		return nil, fmt.Errorf("unknown upload conflict policy %q", policy)
+	}
+	return &Uploads{root: root, policy: policy}, nil
+}
+
+// Policy returns the conflict policy.
+func (u *Uploads) Policy() string {
+	return u.policy
+}
+
+// Name returns the name an upload of name by owner would be stored under right now, or ErrExists.
+// Commit checks again, since another upload may take the name in between.
+func (u *Uploads) Name(name, owner string) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.resolve(name, owner)
+}
+
+// Commit moves the completed upload at tmp into place as name (or the name the policy picks),
+// versioning or replacing an existing file as the policy allows, and records owner. It returns the
+// name the file was stored under.
+func (u *Uploads) Commit(tmp, name, owner string) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	stored, err := u.resolve(name, owner)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(u.root, stored)
+	if u.policy == ConflictVersion {
+		if err := u.keepVersion(stored); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return "", err
+	}
+	owners, err := u.owners()
+	if err != nil {
+		return stored, err
+	}
+	owners[stored] = owner
+	return stored, u.saveOwners(owners)
+}
+
+// PartialPath returns the hidden file in the root that holds owner's unfinished upload of name.
+// It is kept when an upload is interrupted so the same owner can resume it.
+func (u *Uploads) PartialPath(name, owner string) string {
+	return filepath.Join(u.root, "."+name+partialSuffix(owner))
+}
+
+// partialSuffix is the end of the names of owner's partial files: ".<hash of owner>.part".
+func partialSuffix(owner string) string {
+	sum := sha256.Sum256([]byte(owner))
+	return "." + hex.EncodeToString(sum[:4]) + ".part"
+}
+
+// isPartial reports whether name (a file in the root) looks like a partial upload.
+func isPartial(name string) bool {
+	if !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".part") {
+		return false
+	}
+	rest := strings.TrimSuffix(name, ".part")
+	i := strings.LastIndexByte(rest, '.')
+	if i <= 0 || len(rest)-i-1 != 8 {
+		return false
+	}
+	_, err := hex.DecodeString(rest[i+1:])
+	return err == nil
+}
+
+// ExpirePartials removes partial uploads not written to for longer than maxAge, except those busy
+// reports as still being written. It returns how many it removed.
+func (u *Uploads) ExpirePartials(maxAge time.Duration, busy func(path string) bool) (int, error) {
+	entries, err := os.ReadDir(u.root)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !isPartial(e.Name()) {
+			continue
+		}
+		path := filepath.Join(u.root, e.Name())
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) <= maxAge || (busy != nil && busy(path)) {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Owner returns who uploaded name, or "" if unknown.
+func (u *Uploads) Owner(name string) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	owners, err := u.owners()
+	if err != nil {
+		return "", err
+	}
+	return owners[name], nil
+}
+
+// Usage returns the total size of the files owner uploaded that are still in the root, including
+// owner's partial uploads.
+func (u *Uploads) Usage(owner string) (int64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	owners, err := u.owners()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for name, o := range owners {
+		if o != owner {
+			continue
+		}
+		if info, err := os.Lstat(filepath.Join(u.root, name)); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+	}
+	entries, err := os.ReadDir(u.root)
+	if err != nil {
+		return 0, err
+	}
+	suffix := partialSuffix(owner)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !isPartial(e.Name()) || !strings.HasSuffix(e.Name(), suffix) {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
+
+func (u *Uploads) resolve(name, owner string) (string, error) {
+	if !u.exists(name) {
+		return name, nil
+	}
+	switch u.policy {
+	case ConflictRename:
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+			if !u.exists(candidate) {
+				return candidate, nil
+			}
+		}
+	case ConflictVersion:
+		if u.regular(name) {
+			return name, nil
+		}
+	case ConflictOwner:
+		if !u.regular(name) {
+			break
+		}
+		owners, err := u.owners()
+		if err != nil {
+			return "", err
+		}
+		if o := owners[name]; o != "" && o == owner {
+			return name, nil
+		}
+	}
+	return "", ErrExists
+}
+
+func (u *Uploads) exists(name string) bool {
+	_, err := os.Lstat(filepath.Join(u.root, name))
+	return err == nil
+}
+
+// regular reports whether name is a regular file, the only kind of entry an upload may replace; a
+// directory or symlink is never versioned away or overwritten.
+func (u *Uploads) regular(name string) bool {
+	info, err := os.Lstat(filepath.Join(u.root, name))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// keepVersion moves an existing name into VersionsDir as "name.YYYYMMDD-HHMMSS" (its modification time).
+func (u *Uploads) keepVersion(name string) error {
+	src := filepath.Join(u.root, name)
+	info, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return ErrExists
+	}
+	dir := filepath.Join(u.root, VersionsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, name+"."+info.ModTime().Format("20060102-150405"))
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			break
+		}
+		dst = filepath.Join(dir, fmt.Sprintf("%s.%s-%d", name, info.ModTime().Format("20060102-150405"), i))
+	}
+	return os.Rename(src, dst)
+}
+
+func (u *Uploads) owners() (map[string]string, error) {
+	owners := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(u.root, ownersFile))
+	if os.IsNotExist(err) {
+		return owners, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &owners); err != nil {
+		return nil, fmt.Errorf("%s: %w", ownersFile, err)
+	}
+	return owners, nil
+}
+
+func (u *Uploads) saveOwners(owners map[string]string) error {
+	data, err := json.MarshalIndent(owners, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(u.root, ownersFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(u.root, ownersFile))
+}
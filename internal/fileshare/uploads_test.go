@@ -0,0 +1,207 @@
+package fileshare
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// commit stores content as name through u, via a temporary file like the bot does.
+func commit(t *testing.T, u *Uploads, name, owner, content string) (string, error) {
+	t.Helper()
+	tmp, err := os.CreateTemp(u.root, ".upload-*.part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.WriteString(content)
+	tmp.Close()
+	stored, err := u.Commit(tmp.Name(), name, owner)
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return stored, err
+}
+
+func read(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestUploadsPolicies(t *testing.T) {
+	tests := []struct {
+		policy   string
+		owner    string // second uploader
+		wantName string
+		wantErr  error
+		want     string // content of a.txt afterwards
+	}{
+		{ConflictReject, "alice", "", ErrExists, "one"},
+		{ConflictRename, "bob", "a-1.txt", nil, "one"},
+		{ConflictVersion, "bob", "a.txt", nil, "two"},
+		{ConflictOwner, "alice", "a.txt", nil, "two"},
+		{ConflictOwner, "bob", "", ErrExists, "one"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.owner, func(t *testing.T) {
+			root := t.TempDir()
+			u, err := NewUploads(root, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored, err := commit(t, u, "a.txt", "alice", "one"); err != nil || stored != "a.txt" {
+				t.Fatalf("first upload: %q, %v", stored, err)
+			}
+			if name, err := u.Name("a.txt", tt.owner); name != tt.wantName || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Name = %q, %v; want %q, %v", name, err, tt.wantName, tt.wantErr)
+			}
+			stored, err := commit(t, u, "a.txt", tt.owner, "two")
+			if stored != tt.wantName || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Commit = %q, %v; want %q, %v", stored, err, tt.wantName, tt.wantErr)
+			}
+			if got := read(t, filepath.Join(root, "a.txt")); got != tt.want {
+				t.Errorf("a.txt = %q, want %q", got, tt.want)
+			}
+			if err == nil {
+				if owner, _ := u.Owner(stored); owner != tt.owner {
+					t.Errorf("owner of %s = %q, want %q", stored, owner, tt.owner)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadsRenameSequence(t *testing.T) {
+	root := t.TempDir()
+	u, _ := NewUploads(root, ConflictRename)
+	for _, want := range []string{"a.txt", "a-1.txt", "a-2.txt"} {
+		if stored, err := commit(t, u, "a.txt", "alice", want); err != nil || stored != want {
+			t.Errorf("stored %q, %v; want %q", stored, err, want)
+		}
+	}
+}
+
+func TestUploadsVersions(t *testing.T) {
+	root := t.TempDir()
+	u, _ := NewUploads(root, ConflictVersion)
+	for _, content := range []string{"v1", "v2", "v3"} {
+		if _, err := commit(t, u, "a.txt", "alice", content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(root, VersionsDir))
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("versions = %v, %v", entries, err)
+	}
+	got := map[string]bool{}
+	for _, e := range entries {
+		got[read(t, filepath.Join(root, VersionsDir, e.Name()))] = true
+	}
+	if !got["v1"] || !got["v2"] || read(t, filepath.Join(root, "a.txt")) != "v3" {
+		t.Errorf("versions %v", got)
+	}
+}
+
+func TestUploadsDirectoryNotReplaced(t *testing.T) {
+	for _, policy := range []string{ConflictVersion, ConflictOwner} {
+		t.Run(policy, func(t *testing.T) {
+			root := makeTree(t, "docs/x.pdf")
+			u, _ := NewUploads(root, policy)
+			u.saveOwners(map[string]string{"docs": "alice"})
+			if _, err := u.Name("docs", "alice"); !errors.Is(err, ErrExists) {
+				t.Errorf("Name = %v, want ErrExists", err)
+			}
+			if _, err := commit(t, u, "docs", "alice", "file"); !errors.Is(err, ErrExists) {
+				t.Errorf("Commit = %v, want ErrExists", err)
+			}
+			if got := read(t, filepath.Join(root, "docs", "x.pdf")); got != "docs/x.pdf" {
+				t.Errorf("docs/x.pdf = %q", got)
+			}
+			if _, err := os.Stat(filepath.Join(root, VersionsDir)); !os.IsNotExist(err) {
+				t.Errorf("directory was versioned: %v", err)
+			}
+		})
+	}
+	// keepVersion checks again, in case the name became a directory after resolve.
+	root := makeTree(t, "docs/x.pdf")
+	u, _ := NewUploads(root, ConflictVersion)
+	if err := u.keepVersion("docs"); !errors.Is(err, ErrExists) {
+		t.Errorf("keepVersion = %v, want ErrExists", err)
+	}
+}
+
+func TestNewUploadsPolicy(t *testing.T) {
+	if u, err := NewUploads(t.TempDir(), ""); err != nil || u.Policy() != ConflictReject {
+		t.Errorf("default policy = %v, %v", u, err)
+	}
+	if _, err := NewUploads(t.TempDir(), "clobber"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestPartialPath(t *testing.T) {
+	u, _ := NewUploads(t.TempDir(), "")
+	a, b := u.PartialPath("a.txt", "alice@host"), u.PartialPath("a.txt", "bob@host")
+	if a == b || a != u.PartialPath("a.txt", "alice@host") {
+		t.Errorf("partial paths %q, %q", a, b)
+	}
+	if filepath.Dir(a) != u.root || !IsHidden(filepath.Base(a)) {
+		t.Errorf("partial %q is not hidden in the root", a)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	root := t.TempDir()
+	u, _ := NewUploads(root, ConflictRename)
+	commit(t, u, "a.txt", "alice", "12345")
+	commit(t, u, "a.txt", "alice", "123")
+	commit(t, u, "b.txt", "bob", "1234567")
+	os.Remove(filepath.Join(root, "a-1.txt"))
+	os.WriteFile(u.PartialPath("c.txt", "alice"), []byte("12"), 0644)
+	for owner, want := range map[string]int64{"alice": 7, "bob": 7, "carol": 0} {
+		if got, err := u.Usage(owner); err != nil || got != want {
+			t.Errorf("Usage(%s) = %d, %v; want %d", owner, got, err, want)
+		}
+	}
+}
+
+func TestExpirePartials(t *testing.T) {
+	root := t.TempDir()
+	u, _ := NewUploads(root, "")
+	old, busy, recent := u.PartialPath("a.txt", "alice"), u.PartialPath("b.txt", "alice"), u.PartialPath("a.txt", "bob")
+	other := filepath.Join(root, ".notes.part")
+	for _, p := range []string{old, busy, recent, other} {
+		os.WriteFile(p, []byte("x"), 0644)
+	}
+	week := time.Now().Add(-8 * 24 * time.Hour)
+	for _, p := range []string{old, busy, other} {
+		os.Chtimes(p, week, week)
+	}
+	n, err := u.ExpirePartials(PartialMaxAge, func(p string) bool { return p == busy })
+	if err != nil || n != 1 {
+		t.Fatalf("ExpirePartials = %d, %v; want 1", n, err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("stale partial kept")
+	}
+	for _, p := range []string{busy, recent, other} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("%s removed", filepath.Base(p))
+		}
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	free, err := FreeSpace(t.TempDir())
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil || free <= 0 {
+		t.Errorf("FreeSpace = %d, %v", free, err)
+	}
+}
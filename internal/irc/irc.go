@@ -1,14 +1,27 @@
 package irc
 
 import (
-	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/awgh/huzaa-bot/internal/tlsutil"
+	sasl "github.com/emersion/go-sasl"
 	irc "github.com/fluffle/goirc/client"
 )
 
+// CapAccountTag is the IRCv3 capability that tags messages with the sender's services account.
+const CapAccountTag = "account-tag"
+
+// SASL mechanisms supported by Connect.
+const (
+	SASLPlain    = "PLAIN"
+	SASLExternal = "EXTERNAL"
+)
+
 // Config holds IRC connection config (Marvin-style).
 type Config struct {
 	Host         string
@@ -22,13 +35,78 @@ type Config struct {
 	ProxyEnabled bool
 	Proxy        string
 	SASL         bool
+	// SASLMechanism is PLAIN (default) or EXTERNAL. PLAIN authenticates as SASLAccount (default Nick)
+	// with SASLPassword; EXTERNAL authenticates with the client certificate in ClientCertFile/ClientKeyFile.
+	SASLMechanism string
+	SASLAccount   string
+	SASLPassword  string
+	// ClientCertFile and ClientKeyFile are an optional PEM client certificate and key presented during
+	// the TLS handshake, for CertFP identification and SASL EXTERNAL.
+	ClientCertFile string
+	ClientKeyFile  string
+	// Plaintext connects without TLS. Only allowed when Host is a loopback address.
+	Plaintext bool
+	// TLSSkipVerify disables server certificate verification.
+	TLSSkipVerify bool
+	// TLSCAFile is a PEM bundle trusted instead of the system roots.
+	TLSCAFile string
+	// TLSFingerprint pins the server certificate by its SHA-256 fingerprint (hex, colons optional).
+	TLSFingerprint string
+	// AccountTag requests the IRCv3 account-tag capability so messages carry the sender's account.
+	AccountTag bool
+	// NoFlood turns off goirc's flood control. Only allowed with Plaintext, for tests against a
+	// local server; pair it with an Output whose Rate is < 0.
+	NoFlood bool
 }
 
-// Connect creates and connects an IRC client. Caller must call conn.Connect() and set handlers.
-func Connect(cfg *Config) *irc.Conn {
+// Connect creates an IRC client. Caller must call conn.Connect() and set handlers.
+// It returns an error if the TLS, SASL or client certificate settings are invalid.
+// goirc's flood control stays on for everything the connection sends, including its automatic
+// CTCP replies; send replies through an Output, which keeps them within it so they queue fairly
+// instead of ahead of PONGs.
+func Connect(cfg *Config) (*irc.Conn, error) {
 	ircCfg := irc.NewConfig(cfg.Nick)
-	ircCfg.SSL = true
-	ircCfg.SSLConfig = &tls.Config{ServerName: cfg.Host, InsecureSkipVerify: true}
+	if cfg.Plaintext {
+		if !isLoopback(cfg.Host) {
+			return nil, fmt.Errorf("plaintext IRC is only allowed to loopback hosts, not %q", cfg.Host)
+		}
+		if cfg.SASL && strings.EqualFold(cfg.SASLMechanism, SASLExternal) {
+			return nil, errors.New("sasl: EXTERNAL requires TLS")
+		}
+		ircCfg.Flood = cfg.NoFlood
+	} else {
+		if cfg.NoFlood {
+			return nil, errors.New("flood control can only be turned off for plaintext loopback connections")
+		}
+		opts := &tlsutil.Options{
+			ServerName: cfg.Host,
+			SkipVerify: cfg.TLSSkipVerify,
+			CAFile:     cfg.TLSCAFile,
+			CertFile:   cfg.ClientCertFile,
+			KeyFile:    cfg.ClientKeyFile,
+		}
+		if cfg.TLSFingerprint != "" {
+			opts.Fingerprints = []string{cfg.TLSFingerprint}
+		}
+		tlsCfg, err := tlsutil.Config(opts)
+		if err != nil {
+			return nil, err
+		}
+		ircCfg.SSL = true
+		ircCfg.SSLConfig = tlsCfg
+	}
+	if cfg.SASL {
+		client, err := saslClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		ircCfg.Sasl = client
+		ircCfg.EnableCapabilityNegotiation = true
+	}
+	if cfg.AccountTag {
+		ircCfg.Capabilites = append(ircCfg.Capabilites, CapAccountTag)
+		ircCfg.EnableCapabilityNegotiation = true
+	}
 	ircCfg.Server = cfg.Host + ":" + cfg.Port
 	ircCfg.Me.Ident = cfg.Nick
 	ircCfg.Me.Name = cfg.Name
@@ -41,7 +119,54 @@ func Connect(cfg *Config) *irc.Conn {
 	}
 	conn := irc.Client(ircCfg)
 	conn.EnableStateTracking()
-	return conn
+	return conn, nil
+}
+
+// isLoopback reports whether host is localhost or a loopback IP address.
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// saslClient returns the SASL client for cfg.SASLMechanism.
+func saslClient(cfg *Config) (sasl.Client, error) {
+	switch strings.ToUpper(cfg.SASLMechanism) {
+	case "", SASLPlain:
+		account := cfg.SASLAccount
+		if account == "" {
+			account = cfg.Nick
+		}
+		if cfg.SASLPassword == "" {
+			return nil, errors.New("sasl: PLAIN requires SASLPassword")
+		}
+		return sasl.NewPlainClient("", account, cfg.SASLPassword), nil
+	case SASLExternal:
+		if cfg.ClientCertFile == "" {
+			return nil, errors.New("sasl: EXTERNAL requires a client certificate (ClientCertFile, ClientKeyFile)")
+		}
+		return sasl.NewExternalClient(cfg.SASLAccount), nil
+	default:
+		return nil, fmt.Errorf("sasl: unsupported mechanism %q", cfg.SASLMechanism)
+	}
+}
+
+// OnSASLFailure calls fn when the server rejects SASL authentication (ERR_NICKLOCKED, ERR_SASLFAIL,
+// ERR_SASLTOOLONG, ERR_SASLABORTED) or registration completes without SASL because the server
+// does not offer it. goirc itself only logs the failure and continues unauthenticated.
+func OnSASLFailure(conn *irc.Conn, fn func(reason string)) {
+	for _, numeric := range []string{"902", "904", "905", "906"} {
+		conn.HandleFunc(numeric, func(c *irc.Conn, l *irc.Line) {
+			fn(l.Cmd + " " + l.Text())
+		})
+	}
+	conn.HandleFunc(irc.CONNECTED, func(c *irc.Conn, l *irc.Line) {
+		if c.Config().Sasl != nil && !c.HasCapability("sasl") {
+			fn("server does not support SASL")
+		}
+	})
 }
 
 // JoinChannel joins the configured channel on CONNECTED.
@@ -0,0 +1,53 @@
+package irc
+
+import "testing"
+
+func TestConnectConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"plain", Config{Nick: "bot", SASL: true, SASLPassword: "pw"}, false},
+		{"plain without password", Config{Nick: "bot", SASL: true}, true},
+		{"external without cert", Config{Nick: "bot", SASL: true, SASLMechanism: "external"}, true},
+		{"unknown mechanism", Config{Nick: "bot", SASL: true, SASLMechanism: "SCRAM-SHA-256", SASLPassword: "pw"}, true},
+		{"missing cert file", Config{Nick: "bot", ClientCertFile: "/nonexistent.pem", ClientKeyFile: "/nonexistent.key"}, true},
+		{"sasl disabled", Config{Nick: "bot", SASLMechanism: "bogus"}, false},
+		{"plaintext loopback", Config{Nick: "bot", Host: "127.0.0.1", Plaintext: true}, false},
+		{"plaintext localhost", Config{Nick: "bot", Host: "localhost", Plaintext: true}, false},
+		{"plaintext remote", Config{Nick: "bot", Host: "irc.example.net", Plaintext: true}, true},
+		{"plaintext external", Config{Nick: "bot", Host: "::1", Plaintext: true, SASL: true, SASLMechanism: "EXTERNAL", ClientCertFile: "c.pem"}, true},
+		{"bad fingerprint", Config{Nick: "bot", TLSFingerprint: "abcd"}, true},
+		{"missing ca file", Config{Nick: "bot", TLSCAFile: "/nonexistent.pem"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := Connect(&tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.cfg.SASL && conn.Config().Sasl == nil {
+				t.Error("SASL enabled but no SASL client configured")
+			}
+		})
+	}
+}
+
+func TestConnectTLS(t *testing.T) {
+	conn, err := Connect(&Config{Nick: "bot", Host: "irc.example.net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := conn.Config()
+	if !cfg.SSL || cfg.SSLConfig.InsecureSkipVerify || cfg.SSLConfig.ServerName != "irc.example.net" {
+		t.Errorf("default TLS config does not verify the server: SSL=%v %+v", cfg.SSL, cfg.SSLConfig)
+	}
+	conn, err = Connect(&Config{Nick: "bot", Host: "127.0.0.1", Plaintext: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Config().SSL {
+		t.Error("plaintext config enabled SSL")
+	}
+}
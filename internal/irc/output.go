@@ -0,0 +1,271 @@
+package irc
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/awgh/huzaa-bot/internal/ratelimit"
+)
+
+// MaxLineBytes is the IRC line limit, including the trailing CRLF and the prefix the server adds
+// when relaying the message.
+const MaxLineBytes = 512
+
+// prefixReserve is the room left for the ":nick!ident@host " prefix the server prepends when it
+// relays our messages (30-character nick, 10-character ident, 63-character host).
+const prefixReserve = 1 + 30 + 1 + 10 + 1 + 63 + 1
+
+// Output defaults used when OutputConfig fields are zero.
+const (
+	DefaultSendRate  = 2.0 // lines per second
+	DefaultSendBurst = 5
+)
+
+// Writer is the connection Output sends raw lines through. *irc.Conn implements it.
+type Writer interface {
+	Raw(line string)
+	Connected() bool
+}
+
+// OutputConfig sets the pacing of an Output.
+type OutputConfig struct {
+	Rate  float64 // lines per second; 0 means DefaultSendRate, < 0 disables pacing
+	Burst int     // lines sent back to back before pacing starts; 0 means DefaultSendBurst
+}
+
+// Output queues PRIVMSG and NOTICE lines per target and sends them at a token-bucket rate, taking
+// one line from each waiting target in turn so one long reply cannot starve everyone else. It also
+// stays within goirc's flood control, which paces everything the connection sends. Long
+// messages are split on UTF-8 boundaries to fit the line limit. It implements bot.Sender.
+type Output struct {
+	w     Writer
+	lim   *ratelimit.Limiter
+	flood *hybrid // nil when pacing is disabled
+
+	mu     sync.Mutex
+	queues map[string][]string // target -> raw lines
+	order  []string            // targets with queued lines, in round-robin order
+	wake   chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewOutput starts an Output writing to w. cfg may be nil. Call Close to stop it.
+func NewOutput(w Writer, cfg *OutputConfig) *Output {
+	rate, burst := DefaultSendRate, DefaultSendBurst
+	if cfg != nil {
+		if cfg.Rate != 0 {
+			rate = cfg.Rate
+		}
+		if cfg.Burst > 0 {
+			burst = cfg.Burst
+		}
+	}
+	o := &Output{
+		w:      w,
+		lim:    ratelimit.New(rate, burst),
+		flood:  &hybrid{},
+		queues: make(map[string][]string),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if rate < 0 {
+		o.flood = nil
+	}
+	o.wg.Add(1)
+	go o.run()
+	return o
+}
+
+// Privmsg queues msg to target, split into as many PRIVMSGs as needed.
+func (o *Output) Privmsg(target, msg string) { o.enqueue("PRIVMSG", target, msg) }
+
+// Notice queues msg to target, split into as many NOTICEs as needed.
+func (o *Output) Notice(target, msg string) { o.enqueue("NOTICE", target, msg) }
+
+// CtcpReply queues a CTCP reply (a NOTICE wrapped in \x01). CTCP messages are never split.
+func (o *Output) CtcpReply(target, ctcp string, arg ...string) {
+	msg := ctcp
+	if len(arg) > 0 {
+		msg += " " + strings.Join(arg, " ")
+	}
+	o.enqueue("NOTICE", target, "\x01"+msg+"\x01")
+}
+
+// Pending returns the number of queued lines.
+func (o *Output) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for _, q := range o.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// Close stops sending; lines still queued are dropped.
+func (o *Output) Close() {
+	select {
+	case <-o.done:
+	default:
+		close(o.done)
+	}
+	o.wg.Wait()
+}
+
+func (o *Output) enqueue(cmd, target, msg string) {
+	head := cmd + " " + target + " :"
+	var parts []string
+	if strings.HasPrefix(msg, "\x01") {
+		parts = []string{cutNewlines(msg)}
+	} else {
+		parts = SplitMessage(msg, MaxLineBytes-2-prefixReserve-len(head))
+	}
+	if len(parts) == 0 {
+		return
+	}
+	o.mu.Lock()
+	if len(o.queues[target]) == 0 {
+		o.order = append(o.order, target)
+	}
+	for _, p := range parts {
+		o.queues[target] = append(o.queues[target], head+p)
+	}
+	o.mu.Unlock()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the next line in round-robin order.
+func (o *Output) next() (string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.order) == 0 {
+		return "", false
+	}
+	target := o.order[0]
+	q := o.queues[target]
+	line := q[0]
+	o.order = o.order[1:]
+	if len(q) > 1 {
+		o.queues[target] = q[1:]
+		o.order = append(o.order, target)
+	} else {
+		delete(o.queues, target)
+	}
+	return line, true
+}
+
+func (o *Output) run() {
+	defer o.wg.Done()
+	for {
+		if o.Pending() == 0 {
+			select {
+			case <-o.wake:
+				continue
+			case <-o.done:
+				return
+			}
+		}
+		if !o.lim.Wait(1, o.done) {
+			return
+		}
+		line, ok := o.next()
+		if ok && !o.waitFlood(line) {
+			return
+		}
+		// Lines queued while disconnected are dropped: goirc's Raw blocks once its buffer is full.
+		if ok && o.w.Connected() {
+			o.w.Raw(line)
+		}
+	}
+}
+
+// waitFlood waits until goirc's flood control would send line at once, so lines wait here in
+// turn rather than in goirc's queue ahead of PONGs. It returns false if the Output was closed.
+func (o *Output) waitFlood(line string) bool {
+	if o.flood == nil {
+		return true
+	}
+	d := o.flood.wait(len(line), time.Now())
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-o.done:
+		return false
+	}
+}
+
+// hybrid mirrors goirc's flood control (Hybrid's algorithm): each line costs 2s plus 1/120s per
+// byte, time pays it off, and goirc holds lines back once more than 10s is owed. goirc also counts
+// lines that do not pass through Output (CTCP replies, WHOIS, PONG), so this can only keep its
+// queue short, not empty.
+type hybrid struct {
+	badness time.Duration
+	last    time.Time
+}
+
+// wait accounts for a line of n bytes sent at now plus the returned delay.
+func (h *hybrid) wait(n int, now time.Time) time.Duration {
+	cost := 2*time.Second + time.Duration(n)*time.Second/120
+	if !h.last.IsZero() {
+		if h.badness -= now.Sub(h.last); h.badness < 0 {
+			h.badness = 0
+		}
+	}
+	var d time.Duration
+	if over := h.badness + cost - 10*time.Second; over > 0 {
+		d = over
+	}
+	h.badness += cost - d
+	h.last = now.Add(d)
+	return d
+}
+
+// SplitMessage splits msg into lines of at most max bytes. Embedded newlines start a new line,
+// splits prefer the last space that keeps a line at least half full and never cut a UTF-8
+// sequence. Empty lines are dropped.
+func SplitMessage(msg string, max int) []string {
+	if max < utf8.UTFMax {
+		max = utf8.UTFMax
+	}
+	var out []string
+	for _, line := range strings.Split(strings.ReplaceAll(msg, "\r\n", "\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		for len(line) > max {
+			cut := max
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			if cut == 0 { // not UTF-8; cut anywhere
+				cut = max
+			}
+			if sp := strings.LastIndexByte(line[:cut], ' '); sp >= max/2 {
+				cut = sp
+			}
+			out = append(out, line[:cut])
+			line = strings.TrimLeft(line[cut:], " ")
+		}
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// cutNewlines truncates s at the first CR or LF so it cannot smuggle in another command.
+func cutNewlines(s string) string {
+	if i := strings.IndexAny(s, "\r\n"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,145 @@
+package irc
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		max  int
+		want []string
+	}{
+		{"short", "hello", 10, []string{"hello"}},
+		{"words", "aaaa bbbb cccc", 10, []string{"aaaa bbbb", "cccc"}},
+		{"no spaces", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"newlines", "one\r\ntwo\n\nthree", 10, []string{"one", "two", "three"}},
+		{"utf8", "ééééé", 5, []string{"éé", "éé", "é"}},
+		{"space too early", "a bcdefghij", 6, []string{"a bcde", "fghij"}},
+		{"empty", "", 10, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SplitMessage(tt.msg, tt.max)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			for _, l := range got {
+				if len(l) > tt.max || !utf8.ValidString(l) {
+					t.Errorf("bad line %q", l)
+				}
+			}
+		})
+	}
+}
+
+// recordWriter records raw lines with the time they were written.
+type recordWriter struct {
+	mu    sync.Mutex
+	lines []string
+	times []time.Time
+	down  bool
+}
+
+func (w *recordWriter) Raw(line string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lines = append(w.lines, line)
+	w.times = append(w.times, time.Now())
+}
+
+func (w *recordWriter) Connected() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.down
+}
+
+func (w *recordWriter) wait(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w.mu.Lock()
+		if len(w.lines) >= n {
+			defer w.mu.Unlock()
+			return append([]string(nil), w.lines...)
+		}
+		w.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d lines", n)
+	return nil
+}
+
+func TestOutputLineLimit(t *testing.T) {
+	w := &recordWriter{}
+	o := NewOutput(w, &OutputConfig{Rate: -1})
+	defer o.Close()
+	o.Privmsg("alice", strings.Repeat("word ", 300))
+	o.CtcpReply("alice", "DCC ACCEPT", "a.txt", "1", "2")
+	lines := w.wait(t, 5)
+	for _, l := range lines[:len(lines)-1] {
+		if !strings.HasPrefix(l, "PRIVMSG alice :word") || len(l)+2+prefixReserve > MaxLineBytes {
+			t.Errorf("bad line (%d bytes) %q", len(l), l)
+		}
+	}
+	if last := lines[len(lines)-1]; last != "NOTICE alice :\x01DCC ACCEPT a.txt 1 2\x01" {
+		t.Errorf("CTCP reply = %q", last)
+	}
+}
+
+func TestOutputFairAndPaced(t *testing.T) {
+	w := &recordWriter{}
+	o := NewOutput(w, &OutputConfig{Rate: 20, Burst: 1})
+	defer o.Close()
+	o.Privmsg("alice", "a1\na2\na3")
+	o.Privmsg("bob", "b1")
+	lines := w.wait(t, 4)
+	want := "PRIVMSG alice :a1,PRIVMSG bob :b1,PRIVMSG alice :a2,PRIVMSG alice :a3"
+	if got := strings.Join(lines, ","); got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+	// The first line goes out at once, the others wait 50ms each.
+	if d := w.times[3].Sub(w.times[0]); d < 100*time.Millisecond {
+		t.Errorf("4 lines took %v, expected pacing at 20/s", d)
+	}
+}
+
+func TestOutputDisconnected(t *testing.T) {
+	w := &recordWriter{down: true}
+	o := NewOutput(w, &OutputConfig{Rate: -1})
+	o.Privmsg("alice", "dropped")
+	deadline := time.Now().Add(time.Second)
+	for o.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	o.Close()
+	if len(w.lines) != 0 {
+		t.Errorf("wrote %q while disconnected", w.lines)
+	}
+}
+
+func TestHybrid(t *testing.T) {
+	var h hybrid
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		if d := h.wait(0, now); d != 0 {
+			t.Fatalf("line %d waits %v", i+1, d)
+		}
+	}
+	// 4 lines owe 8s; the fifth would owe 10s, which goirc still sends at once.
+	if d := h.wait(0, now); d != 0 {
+		t.Fatalf("line 5 waits %v", d)
+	}
+	if d := h.wait(120, now); d != 3*time.Second {
+		t.Errorf("line 6 waits %v, want 3s", d)
+	}
+	// Time pays the debt off.
+	if d := h.wait(0, now.Add(time.Minute)); d != 0 {
+		t.Errorf("after a minute: wait %v", d)
+	}
+}
@@ -0,0 +1,163 @@
+package irctest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Line is a parsed IRC line.
+type Line struct {
+	Prefix  string // nick!user@host or server name, without the leading ':'
+	Command string
+	Params  []string // the trailing parameter, if any, is the last element
+	Raw     string
+}
+
+// ParseLine parses a raw IRC line (with or without the trailing CRLF).
+func ParseLine(raw string) *Line {
+	raw = strings.TrimRight(raw, "\r\n")
+	l := &Line{Raw: raw}
+	rest := raw
+	if strings.HasPrefix(rest, ":") {
+		i := strings.IndexByte(rest, ' ')
+		if i < 0 {
+			return l
+		}
+		l.Prefix, rest = rest[1:i], rest[i+1:]
+	}
+	for rest != "" {
+		if strings.HasPrefix(rest, ":") {
+			l.Params = append(l.Params, rest[1:])
+			break
+		}
+		i := strings.IndexByte(rest, ' ')
+		if i < 0 {
+			l.Params = append(l.Params, rest)
+			break
+		}
+		if i > 0 {
+			l.Params = append(l.Params, rest[:i])
+		}
+		rest = rest[i+1:]
+	}
+	if len(l.Params) > 0 && l.Command == "" {
+		l.Command, l.Params = strings.ToUpper(l.Params[0]), l.Params[1:]
+	}
+	return l
+}
+
+// Nick returns the nick part of the prefix.
+func (l *Line) Nick() string {
+	if i := strings.IndexByte(l.Prefix, '!'); i >= 0 {
+		return l.Prefix[:i]
+	}
+	return l.Prefix
+}
+
+// Trailing returns the last parameter, or "".
+func (l *Line) Trailing() string {
+	if len(l.Params) == 0 {
+		return ""
+	}
+	return l.Params[len(l.Params)-1]
+}
+
+// Client is a scripted IRC client: it sends raw lines and waits for expected replies.
+// It answers server PINGs itself.
+type Client struct {
+	Nick  string
+	conn  net.Conn
+	lines chan *Line
+}
+
+// DefaultTimeout bounds Expect.
+const DefaultTimeout = 5 * time.Second
+
+// Dial connects to addr and registers as nick, waiting for the welcome numeric.
+func Dial(addr, nick string) (*Client, error) {
+	nc, err := net.DialTimeout("tcp", addr, DefaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{Nick: nick, conn: nc, lines: make(chan *Line, 256)}
+	go c.read()
+	c.Send("NICK " + nick)
+	c.Send("USER " + nick + " 0 * :" + nick)
+	if _, err := c.Expect(func(l *Line) bool { return l.Command == "001" }); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) read() {
+	defer close(c.lines)
+	r := bufio.NewReader(c.conn)
+	for {
+		raw, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		l := ParseLine(raw)
+		if l.Command == "PING" {
+			c.Send("PONG :" + l.Trailing())
+			continue
+		}
+		c.lines <- l
+	}
+}
+
+// Send writes one raw line.
+func (c *Client) Send(line string) error {
+	c.conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
+	_, err := c.conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// Privmsg sends text to target.
+func (c *Client) Privmsg(target, text string) error {
+	return c.Send("PRIVMSG " + target + " :" + text)
+}
+
+// Ctcp sends a CTCP request (PRIVMSG wrapped in \x01) to target.
+func (c *Client) Ctcp(target, text string) error {
+	return c.Privmsg(target, "\x01"+text+"\x01")
+}
+
+// Expect waits up to DefaultTimeout for a line matching match, discarding lines that don't.
+func (c *Client) Expect(match func(*Line) bool) (*Line, error) {
+	timeout := time.After(DefaultTimeout)
+	for {
+		select {
+		case l, ok := <-c.lines:
+			if !ok {
+				return nil, fmt.Errorf("irctest: %s: connection closed", c.Nick)
+			}
+			if match(l) {
+				return l, nil
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("irctest: %s: timed out waiting for line", c.Nick)
+		}
+	}
+}
+
+// ExpectMessage waits for a PRIVMSG or NOTICE (cmd) from nick whose text contains substr.
+func (c *Client) ExpectMessage(cmd, nick, substr string) (*Line, error) {
+	l, err := c.Expect(func(l *Line) bool {
+		return l.Command == cmd && strings.EqualFold(l.Nick(), nick) && strings.Contains(l.Trailing(), substr)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w (%s from %s containing %q)", err, cmd, nick, substr)
+	}
+	return l, nil
+}
+
+// Close sends QUIT and closes the connection.
+func (c *Client) Close() error {
+	c.Send("QUIT :bye")
+	return c.conn.Close()
+}
@@ -0,0 +1,59 @@
+package irctest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	l := ParseLine(":alice!a@127.0.0.1 PRIVMSG bob :\x01DCC RESUME f 1 2\x01\r\n")
+	if l.Prefix != "alice!a@127.0.0.1" || l.Nick() != "alice" || l.Command != "PRIVMSG" {
+		t.Errorf("got %+v", l)
+	}
+	if len(l.Params) != 2 || l.Params[0] != "bob" || l.Trailing() != "\x01DCC RESUME f 1 2\x01" {
+		t.Errorf("params %q", l.Params)
+	}
+	l = ParseLine("ping server")
+	if l.Command != "PING" || l.Trailing() != "server" {
+		t.Errorf("got %+v", l)
+	}
+}
+
+func TestServerRelaysMessages(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	alice, err := Dial(srv.Addr(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := Dial(srv.Addr(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	alice.Ctcp("bob", "VERSION")
+	if _, err := bob.ExpectMessage("PRIVMSG", "alice", "\x01VERSION\x01"); err != nil {
+		t.Fatal(err)
+	}
+	bob.Send("JOIN #c")
+	if err := srv.WaitForMember("#c", "bob", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	alice.Send("JOIN #c")
+	if _, err := bob.Expect(func(l *Line) bool { return l.Command == "JOIN" && l.Nick() == "alice" }); err != nil {
+		t.Fatal(err)
+	}
+	alice.Send("NOTICE #c :hi all")
+	if _, err := bob.ExpectMessage("NOTICE", "alice", "hi all"); err != nil {
+		t.Fatal(err)
+	}
+	alice.Privmsg("nobody", "hello")
+	if _, err := alice.Expect(func(l *Line) bool { return l.Command == "401" }); err != nil {
+		t.Fatal(err)
+	}
+}
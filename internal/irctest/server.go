@@ -0,0 +1,362 @@
+// Package irctest runs a minimal IRC server on loopback plus a scripted client, for end-to-end
+// tests of the bot without a real ircd. The server supports registration (PASS, NICK, USER, CAP LS
+// with no capabilities), PING, JOIN, PART, QUIT, PRIVMSG and NOTICE (CTCP is passed through
+// untouched) and WHOIS.
+package irctest
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerName is the prefix the server uses for numerics.
+const ServerName = "irctest"
+
+// Server is a minimal IRC server listening on 127.0.0.1.
+type Server struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	nicks    map[string]*conn          // lowercase nick -> registered connection
+	channels map[string]map[*conn]bool // lowercase channel -> members
+	conns    map[*conn]bool
+	wg       sync.WaitGroup
+}
+
+type conn struct {
+	srv   *Server
+	nc    net.Conn
+	wmu   sync.Mutex
+	nick  string
+	user  string
+	ready bool // registration complete
+}
+
+// NewServer starts a server on a random loopback port. Call Close when done.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:       ln,
+		nicks:    make(map[string]*conn),
+		channels: make(map[string]map[*conn]bool),
+		conns:    make(map[*conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the server's host:port.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Host returns the server's IP address.
+func (s *Server) Host() string {
+	return s.ln.Addr().(*net.TCPAddr).IP.String()
+}
+
+// Port returns the server's port as a string, as irc.Config expects.
+func (s *Server) Port() string {
+	return strconv.Itoa(s.ln.Addr().(*net.TCPAddr).Port)
+}
+
+// Close stops the server and disconnects all clients.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// WaitForNick waits until a client has registered with nick.
+func (s *Server) WaitForNick(nick string, timeout time.Duration) error {
+	return waitFor(timeout, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		c, ok := s.nicks[strings.ToLower(nick)]
+		return ok && c.ready
+	})
+}
+
+// WaitForMember waits until nick has joined channel.
+func (s *Server) WaitForMember(channel, nick string, timeout time.Duration) error {
+	return waitFor(timeout, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for c := range s.channels[strings.ToLower(channel)] {
+			if strings.EqualFold(c.nick, nick) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func waitFor(timeout time.Duration, cond func() bool) error {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return errors.New("irctest: timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{srv: s, nc: nc}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.run()
+		}()
+	}
+}
+
+func (c *conn) prefix() string {
+	return c.nick + "!" + c.user + "@127.0.0.1"
+}
+
+func (c *conn) send(line string) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	c.nc.Write([]byte(line + "\r\n"))
+}
+
+func (c *conn) numeric(code, text string) {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	c.send(":" + ServerName + " " + code + " " + nick + " " + text)
+}
+
+func (c *conn) run() {
+	defer c.quit("Connection closed")
+	r := bufio.NewReader(c.nc)
+	for {
+		raw, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		l := ParseLine(raw)
+		if l.Command == "" {
+			continue
+		}
+		if !c.handle(l) {
+			return
+		}
+	}
+}
+
+// handle processes one client line. It returns false when the client quits.
+func (c *conn) handle(l *Line) bool {
+	s := c.srv
+	switch l.Command {
+	case "CAP":
+		if len(l.Params) > 0 && strings.EqualFold(l.Params[0], "LS") {
+			c.send(":" + ServerName + " CAP * LS :")
+		} else if len(l.Params) > 1 && strings.EqualFold(l.Params[0], "REQ") {
+			c.send(":" + ServerName + " CAP * NAK :" + l.Params[1])
+		}
+	case "PASS":
+	case "NICK":
+		if len(l.Params) < 1 {
+			c.numeric("431", ":No nickname given")
+			break
+		}
+		nick := l.Params[0]
+		s.mu.Lock()
+		if other, ok := s.nicks[strings.ToLower(nick)]; ok && other != c {
+			s.mu.Unlock()
+			c.numeric("433", nick+" :Nickname is already in use")
+			break
+		}
+		if c.nick != "" {
+			delete(s.nicks, strings.ToLower(c.nick))
+		}
+		old := c.prefix()
+		c.nick = nick
+		s.nicks[strings.ToLower(nick)] = c
+		s.mu.Unlock()
+		if c.ready {
+			c.send(":" + old + " NICK :" + nick)
+		}
+		c.maybeWelcome()
+	case "USER":
+		if len(l.Params) < 1 {
+			c.numeric("461", "USER :Not enough parameters")
+			break
+		}
+		s.mu.Lock()
+		c.user = l.Params[0]
+		s.mu.Unlock()
+		c.maybeWelcome()
+	case "PING":
+		c.send(":" + ServerName + " PONG " + ServerName + " :" + l.Trailing())
+	case "PONG":
+	case "JOIN":
+		if !c.ready || len(l.Params) < 1 {
+			break
+		}
+		for _, ch := range strings.Split(l.Params[0], ",") {
+			c.join(ch)
+		}
+	case "PART":
+		if !c.ready || len(l.Params) < 1 {
+			break
+		}
+		for _, ch := range strings.Split(l.Params[0], ",") {
+			c.part(ch, l.Trailing())
+		}
+	case "PRIVMSG", "NOTICE":
+		if !c.ready || len(l.Params) < 2 {
+			break
+		}
+		c.message(l.Command, l.Params[0], l.Params[1])
+	case "WHOIS":
+		if len(l.Params) < 1 {
+			break
+		}
+		nick := l.Params[len(l.Params)-1]
+		s.mu.Lock()
+		t, ok := s.nicks[strings.ToLower(nick)]
+		s.mu.Unlock()
+		if ok {
+			c.numeric("311", t.nick+" "+t.user+" 127.0.0.1 * :"+t.user)
+		} else {
+			c.numeric("401", nick+" :No such nick/channel")
+		}
+		c.numeric("318", nick+" :End of /WHOIS list")
+	case "QUIT":
+		return false
+	}
+	return true
+}
+
+func (c *conn) maybeWelcome() {
+	c.srv.mu.Lock()
+	if c.ready || c.nick == "" || c.user == "" {
+		c.srv.mu.Unlock()
+		return
+	}
+	c.ready = true
+	c.srv.mu.Unlock()
+	c.numeric("001", ":Welcome to irctest "+c.prefix())
+	c.numeric("422", ":MOTD File is missing")
+}
+
+func (c *conn) join(channel string) {
+	s := c.srv
+	key := strings.ToLower(channel)
+	s.mu.Lock()
+	members := s.channels[key]
+	if members == nil {
+		members = make(map[*conn]bool)
+		s.channels[key] = members
+	}
+	members[c] = true
+	var names []string
+	var others []*conn
+	for m := range members {
+		names = append(names, m.nick)
+		others = append(others, m)
+	}
+	s.mu.Unlock()
+	for _, m := range others {
+		m.send(":" + c.prefix() + " JOIN " + channel)
+	}
+	c.numeric("353", "= "+channel+" :"+strings.Join(names, " "))
+	c.numeric("366", channel+" :End of /NAMES list")
+}
+
+func (c *conn) part(channel, reason string) {
+	s := c.srv
+	key := strings.ToLower(channel)
+	s.mu.Lock()
+	members := s.channels[key]
+	if !members[c] {
+		s.mu.Unlock()
+		return
+	}
+	var others []*conn
+	for m := range members {
+		others = append(others, m)
+	}
+	delete(members, c)
+	s.mu.Unlock()
+	for _, m := range others {
+		m.send(":" + c.prefix() + " PART " + channel + " :" + reason)
+	}
+}
+
+func (c *conn) message(cmd, target, text string) {
+	s := c.srv
+	line := ":" + c.prefix() + " " + cmd + " " + target + " :" + text
+	var to []*conn
+	s.mu.Lock()
+	if strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&") {
+		for m := range s.channels[strings.ToLower(target)] {
+			if m != c {
+				to = append(to, m)
+			}
+		}
+	} else if t, ok := s.nicks[strings.ToLower(target)]; ok {
+		to = append(to, t)
+	}
+	s.mu.Unlock()
+	if len(to) == 0 && cmd == "PRIVMSG" && !strings.HasPrefix(target, "#") {
+		c.numeric("401", target+" :No such nick/channel")
+		return
+	}
+	for _, t := range to {
+		t.send(line)
+	}
+}
+
+// quit removes c from the server and tells the channels it was on.
+func (c *conn) quit(reason string) {
+	s := c.srv
+	s.mu.Lock()
+	delete(s.conns, c)
+	if c.nick != "" && s.nicks[strings.ToLower(c.nick)] == c {
+		delete(s.nicks, strings.ToLower(c.nick))
+	}
+	notify := make(map[*conn]bool)
+	for _, members := range s.channels {
+		if members[c] {
+			delete(members, c)
+			for m := range members {
+				notify[m] = true
+			}
+		}
+	}
+	s.mu.Unlock()
+	for m := range notify {
+		m.send(":" + c.prefix() + " QUIT :" + reason)
+	}
+	c.nc.Close()
+}
@@ -0,0 +1,108 @@
+// Package ratelimit provides a token bucket shared by the IRC output queue and transfer throttling.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket refilled at rate tokens per second up to burst tokens. A nil Limiter
+// or one with rate <= 0 never delays. It is safe for concurrent use.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// New returns a Limiter that starts with a full bucket. burst < 1 is treated as 1.
+func New(rate float64, burst int) *Limiter {
+	l := &Limiter{now: time.Now}
+	l.SetRate(rate, burst)
+	l.tokens = l.burst
+	return l
+}
+
+// SetRate changes the rate and burst; tokens already in the bucket are kept up to the new burst.
+func (l *Limiter) SetRate(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	l.rate = rate
+	l.burst = float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Rate returns the current rate in tokens per second; <= 0 means unlimited.
+func (l *Limiter) Rate() float64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Reserve takes n tokens and returns how long the caller must wait before using them. The bucket
+// may go into debt, so concurrent callers queue up behind each other rather than all waking at once.
+func (l *Limiter) Reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait takes n tokens, sleeping as long as needed, or returns false as soon as done is closed.
+func (l *Limiter) Wait(n int, done <-chan struct{}) bool {
+	return WaitAll(n, done, l)
+}
+
+// WaitAll takes n tokens from every limiter and sleeps until the slowest allows them, or returns
+// false as soon as done is closed. Nil limiters are skipped.
+func WaitAll(n int, done <-chan struct{}, lims ...*Limiter) bool {
+	var d time.Duration
+	for _, l := range lims {
+		if w := l.Reserve(n); w > d {
+			d = w
+		}
+	}
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (l *Limiter) refill() {
+	now := l.now()
+	if !l.last.IsZero() && l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(10, 2)
+	l.now = func() time.Time { return now }
+	l.last = now
+
+	for i, want := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if got := l.Reserve(1); got != want {
+			t.Errorf("reserve %d = %v, want %v", i, got, want)
+		}
+	}
+	// After a second the debt of two tokens is repaid and the bucket is full again.
+	now = now.Add(time.Second)
+	if got := l.Reserve(2); got != 0 {
+		t.Errorf("after refill = %v", got)
+	}
+	if got := l.Reserve(1); got != 100*time.Millisecond {
+		t.Errorf("refill exceeded burst: %v", got)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var nilLimiter *Limiter
+	for _, l := range []*Limiter{nilLimiter, New(0, 1)} {
+		if d := l.Reserve(1 << 20); d != 0 {
+			t.Errorf("unlimited limiter delayed %v", d)
+		}
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(0, 1)
+	l.now = func() time.Time { return now }
+	l.last = now
+	l.SetRate(1000, 100)
+	if got := l.Reserve(200); got != 199*time.Millisecond {
+		t.Errorf("reserve after SetRate = %v", got)
+	}
+}
+
+func TestWaitDone(t *testing.T) {
+	l := New(1, 1)
+	l.Reserve(1)
+	done := make(chan struct{})
+	close(done)
+	if l.Wait(10, done) {
+		t.Error("Wait returned true after done was closed")
+	}
+}
+
+func TestWaitAll(t *testing.T) {
+	fast, slow := New(1e9, 1), New(1, 1)
+	done := make(chan struct{})
+	close(done)
+	if !WaitAll(1, done, nil, fast, slow) {
+		t.Error("tokens in every bucket, but WaitAll waited")
+	}
+	if WaitAll(1, done, fast, slow) {
+		t.Error("the slow limiter did not hold WaitAll back")
+	}
+}
@@ -3,7 +3,10 @@
 package relayprotocol
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"io"
 )
 
@@ -17,8 +20,72 @@ const (
 	MsgEOF              = 0x06
 	MsgAuth             = 0x07
 	MsgAuthOk           = 0x08
+	// Challenge-response auth: the bot sends MsgAuthHello (username), the relay answers
+	// MsgAuthChallenge (NonceSize random bytes), the bot sends MsgAuthResponse (AuthMAC) and
+	// the relay replies MsgAuthOk or MsgError. The secret never crosses the wire.
+	MsgAuthHello     = 0x09
+	MsgAuthChallenge = 0x0A
+	MsgAuthResponse  = 0x0B
+	// MsgHello is the first frame in each direction after the TLS handshake (payload: Hello).
+	MsgHello = 0x0C
 )
 
+// ProtocolVersion is the protocol version this bot speaks. MinProtocolVersion is the oldest relay
+// version it accepts in MsgHello.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Feature bits advertised in Hello.Features. A feature is used only if both sides advertise it.
+const (
+	FeatureChallengeAuth uint32 = 1 << iota // MsgAuthHello / MsgAuthChallenge / MsgAuthResponse
+)
+
+// Features is everything this bot supports.
+const Features = FeatureChallengeAuth
+
+// Hello is the MsgHello payload: 2 byte version + 4 byte feature bitmap (big-endian).
+type Hello struct {
+	Version  uint16
+	Features uint32
+}
+
+// Marshal encodes h as a MsgHello payload.
+func (h Hello) Marshal() []byte {
+	b := make([]byte, 6)
+	binary.BigEndian.PutUint16(b[:2], h.Version)
+	binary.BigEndian.PutUint32(b[2:6], h.Features)
+	return b
+}
+
+// ParseHello decodes a MsgHello payload. Trailing bytes are ignored so later versions can extend it.
+func ParseHello(b []byte) (Hello, error) {
+	if len(b) < 6 {
+		return Hello{}, errors.New("hello too short")
+	}
+	return Hello{Version: binary.BigEndian.Uint16(b[:2]), Features: binary.BigEndian.Uint32(b[2:6])}, nil
+}
+
+// NonceSize is the length of the relay's auth challenge.
+const NonceSize = 32
+
+// AuthMAC returns the MsgAuthResponse payload for username answering nonce:
+// HMAC-SHA256 keyed with secret over "huzaa-relay-auth\x00" + username + "\x00" + nonce.
+func AuthMAC(secret, username string, nonce []byte) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte("huzaa-relay-auth\x00"))
+	m.Write([]byte(username))
+	m.Write([]byte{0})
+	m.Write(nonce)
+	return m.Sum(nil)
+}
+
+// CheckAuthMAC reports whether mac is the valid response for username, secret and nonce.
+func CheckAuthMAC(secret, username string, nonce, mac []byte) bool {
+	return hmac.Equal(mac, AuthMAC(secret, username, nonce))
+}
+
 // ReadFrame reads one frame: 1 byte type + 4 byte length (big-endian) + payload.
 func ReadFrame(r io.Reader) (msgType byte, payload []byte, err error) {
 	var h [5]byte
@@ -0,0 +1,55 @@
+package relayprotocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, MsgData, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFrame(&buf, MsgEOF, nil); err != nil {
+		t.Fatal(err)
+	}
+	msgType, payload, err := ReadFrame(&buf)
+	if err != nil || msgType != MsgData || string(payload) != "hello" {
+		t.Errorf("got %d %q %v", msgType, payload, err)
+	}
+	msgType, payload, err = ReadFrame(&buf)
+	if err != nil || msgType != MsgEOF || len(payload) != 0 {
+		t.Errorf("got %d %q %v", msgType, payload, err)
+	}
+}
+
+func TestAuthMAC(t *testing.T) {
+	nonce := bytes.Repeat([]byte{1}, NonceSize)
+	mac := AuthMAC("secret", "bot", nonce)
+	if !CheckAuthMAC("secret", "bot", nonce, mac) {
+		t.Error("valid MAC rejected")
+	}
+	if CheckAuthMAC("other", "bot", nonce, mac) {
+		t.Error("MAC accepted with wrong secret")
+	}
+	if CheckAuthMAC("secret", "eve", nonce, mac) {
+		t.Error("MAC accepted for another user")
+	}
+	if CheckAuthMAC("secret", "bot", bytes.Repeat([]byte{2}, NonceSize), mac) {
+		t.Error("MAC accepted for another nonce")
+	}
+	if bytes.Contains(mac, []byte("secret")) {
+		t.Error("MAC contains the secret")
+	}
+}
+
+func TestHello(t *testing.T) {
+	h := Hello{Version: ProtocolVersion, Features: Features}
+	got, err := ParseHello(append(h.Marshal(), 0xff))
+	if err != nil || got != h {
+		t.Errorf("got %+v %v, want %+v", got, err, h)
+	}
+	if _, err := ParseHello([]byte{0, 1}); err == nil {
+		t.Error("expected error for short hello")
+	}
+}
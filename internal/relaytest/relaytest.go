@@ -0,0 +1,374 @@
+// Package relaytest runs an in-process relay for tests. It implements the relay's side of
+// relayprotocol (hello, challenge-response and legacy auth, download/upload registration, port
+// allocation and data forwarding) over a loopback TLS listener with a generated certificate.
+//
+// DCC peers connect to the allocated ports over plain TCP: for a download the peer receives the
+// bytes the bot sends, for an upload the bytes the peer writes are forwarded to the bot.
+package relaytest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/relayprotocol"
+)
+
+// Config configures a Server.
+type Config struct {
+	// Users maps relay usernames to secrets (the relay's turn_users).
+	Users map[string]string
+	// LegacyOnly makes the server behave like a relay that predates MsgHello and challenge-response
+	// auth: the first frame must be MsgAuth.
+	LegacyOnly bool
+	// Features is advertised in MsgHello. Zero means relayprotocol.Features.
+	Features uint32
+	// DropUploads makes the relay close the bot's upload connection without MsgEOF when the peer
+	// disconnects, as happens when a transfer is aborted.
+	DropUploads bool
+	// RejectRegister, if set, is sent as MsgError in answer to every registration.
+	RejectRegister string
+}
+
+// Registration records one MsgRegisterDownload or MsgRegisterUpload.
+type Registration struct {
+	SessionID string
+	Filename  string
+	Upload    bool
+	Port      int
+}
+
+// Server is a fake relay listening on 127.0.0.1.
+type Server struct {
+	cfg  Config
+	ln   net.Listener
+	pool *x509.CertPool
+
+	mu            sync.Mutex
+	registrations []Registration
+	closers       []io.Closer
+	closed        bool
+	wg            sync.WaitGroup
+}
+
+// NewServer starts a relay on a random loopback port. Call Close when done.
+func NewServer(cfg *Config) (*Server, error) {
+	cert, pool, err := generateCert()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{cfg: *cfg, ln: ln, pool: pool}
+	if s.cfg.Features == 0 {
+		s.cfg.Features = relayprotocol.Features
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// URL returns the relay URL to pass to turnclient.NewClient.
+func (s *Server) URL() string {
+	return "turns://" + s.ln.Addr().String()
+}
+
+// TLSConfig returns a client TLS config that trusts the server's generated certificate.
+func (s *Server) TLSConfig() *tls.Config {
+	return &tls.Config{RootCAs: s.pool, MinVersion: tls.VersionTLS12}
+}
+
+// Registrations returns the sessions registered so far.
+func (s *Server) Registrations() []Registration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Registration(nil), s.registrations...)
+}
+
+// Close stops the listener, closes all connections and waits for the server goroutines.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	closers := s.closers
+	s.closers = nil
+	s.mu.Unlock()
+	err := s.ln.Close()
+	for _, c := range closers {
+		c.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+// track registers c to be closed by Close. It returns false if the server is already closed.
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		c.Close()
+		return false
+	}
+	s.closers = append(s.closers, c)
+	return true
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(conn) {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	if !s.handshake(conn) {
+		return
+	}
+	msgType, payload, err := relayprotocol.ReadFrame(conn)
+	if err != nil {
+		return
+	}
+	if msgType != relayprotocol.MsgRegisterDownload && msgType != relayprotocol.MsgRegisterUpload {
+		writeError(conn, "expected register")
+		return
+	}
+	if len(payload) < 36 {
+		writeError(conn, "short register payload")
+		return
+	}
+	if s.cfg.RejectRegister != "" {
+		writeError(conn, s.cfg.RejectRegister)
+		return
+	}
+	reg := Registration{
+		SessionID: strings.TrimRight(string(payload[:36]), "\x00"),
+		Filename:  string(payload[36:]),
+		Upload:    msgType == relayprotocol.MsgRegisterUpload,
+	}
+	peerLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		writeError(conn, err.Error())
+		return
+	}
+	if !s.track(peerLn) {
+		return
+	}
+	defer peerLn.Close()
+	reg.Port = peerLn.Addr().(*net.TCPAddr).Port
+	s.mu.Lock()
+	s.registrations = append(s.registrations, reg)
+	s.mu.Unlock()
+
+	var port [4]byte
+	binary.BigEndian.PutUint32(port[:], uint32(reg.Port))
+	if err := relayprotocol.WriteFrame(conn, relayprotocol.MsgPortAlloc, port[:]); err != nil {
+		return
+	}
+	peer, err := peerLn.Accept()
+	if err != nil {
+		return
+	}
+	if !s.track(peer) {
+		return
+	}
+	defer peer.Close()
+	if reg.Upload {
+		forwardUpload(conn, peer, !s.cfg.DropUploads)
+	} else {
+		forwardDownload(conn, peer)
+	}
+}
+
+// handshake runs hello and auth. It returns false if the connection must be dropped.
+func (s *Server) handshake(conn net.Conn) bool {
+	msgType, payload, err := relayprotocol.ReadFrame(conn)
+	if err != nil {
+		return false
+	}
+	if !s.cfg.LegacyOnly {
+		if msgType != relayprotocol.MsgHello {
+			writeError(conn, "expected hello")
+			return false
+		}
+		if _, err := relayprotocol.ParseHello(payload); err != nil {
+			writeError(conn, err.Error())
+			return false
+		}
+		h := relayprotocol.Hello{Version: relayprotocol.ProtocolVersion, Features: s.cfg.Features}
+		if err := relayprotocol.WriteFrame(conn, relayprotocol.MsgHello, h.Marshal()); err != nil {
+			return false
+		}
+		if msgType, payload, err = relayprotocol.ReadFrame(conn); err != nil {
+			return false
+		}
+	}
+	switch {
+	case msgType == relayprotocol.MsgAuth:
+		return s.legacyAuth(conn, payload)
+	case msgType == relayprotocol.MsgAuthHello && !s.cfg.LegacyOnly && s.cfg.Features&relayprotocol.FeatureChallengeAuth != 0:
+		return s.challengeAuth(conn, string(payload))
+	default:
+		writeError(conn, "auth required")
+		return false
+	}
+}
+
+func (s *Server) legacyAuth(conn net.Conn, payload []byte) bool {
+	if len(payload) < 4 {
+		writeError(conn, "short auth payload")
+		return false
+	}
+	n := binary.BigEndian.Uint32(payload[:4])
+	if int(n) > len(payload)-4 {
+		writeError(conn, "short auth payload")
+		return false
+	}
+	user, secret := string(payload[4:4+n]), string(payload[4+n:])
+	if want, ok := s.cfg.Users[user]; !ok || want != secret {
+		writeError(conn, "invalid credentials")
+		return false
+	}
+	return relayprotocol.WriteFrame(conn, relayprotocol.MsgAuthOk, nil) == nil
+}
+
+func (s *Server) challengeAuth(conn net.Conn, user string) bool {
+	nonce := make([]byte, relayprotocol.NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return false
+	}
+	if err := relayprotocol.WriteFrame(conn, relayprotocol.MsgAuthChallenge, nonce); err != nil {
+		return false
+	}
+	msgType, mac, err := relayprotocol.ReadFrame(conn)
+	if err != nil {
+		return false
+	}
+	secret, ok := s.cfg.Users[user]
+	if msgType != relayprotocol.MsgAuthResponse || !ok || !relayprotocol.CheckAuthMAC(secret, user, nonce, mac) {
+		writeError(conn, "invalid credentials")
+		return false
+	}
+	return relayprotocol.WriteFrame(conn, relayprotocol.MsgAuthOk, nil) == nil
+}
+
+// forwardDownload copies MsgData payloads from the bot to the peer until MsgEOF.
+func forwardDownload(bot, peer net.Conn) {
+	for {
+		msgType, payload, err := relayprotocol.ReadFrame(bot)
+		if err != nil || msgType == relayprotocol.MsgEOF {
+			return
+		}
+		if msgType != relayprotocol.MsgData {
+			writeError(bot, fmt.Sprintf("unexpected msg type %d", msgType))
+			return
+		}
+		if _, err := peer.Write(payload); err != nil {
+			writeError(bot, err.Error())
+			return
+		}
+	}
+}
+
+// forwardUpload sends what the peer writes to the bot as MsgData frames, then MsgEOF if sendEOF.
+func forwardUpload(bot, peer net.Conn, sendEOF bool) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := peer.Read(buf)
+		if n > 0 {
+			if werr := relayprotocol.WriteFrame(bot, relayprotocol.MsgData, buf[:n]); werr != nil {
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			if sendEOF {
+				relayprotocol.WriteFrame(bot, relayprotocol.MsgEOF, nil)
+			}
+			return
+		}
+		if err != nil {
+			writeError(bot, err.Error())
+			return
+		}
+	}
+}
+
+func writeError(conn net.Conn, msg string) {
+	relayprotocol.WriteFrame(conn, relayprotocol.MsgError, []byte(msg))
+}
+
+// generateCert returns a self-signed certificate for 127.0.0.1 / localhost and a pool trusting it.
+func generateCert() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "relaytest"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool, nil
+}
+
+// Fetch connects to an allocated download port as the DCC peer and returns all bytes received.
+func Fetch(port int) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return io.ReadAll(conn)
+}
+
+// Send connects to an allocated upload port as the DCC peer, writes data and closes the connection.
+func Send(port int, data []byte) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(data)
+	return err
+}
@@ -0,0 +1,130 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a self-signed certificate for localhost and its PEM encoding.
+func selfSigned(t *testing.T) (tls.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// handshake runs a TLS handshake between a server presenting cert and a client using cfg.
+func handshake(cert tls.Certificate, cfg *tls.Config) error {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go tls.Server(s, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+	return tls.Client(c, cfg).Handshake()
+}
+
+func TestConfigVerification(t *testing.T) {
+	cert, certPEM := selfSigned(t)
+	sum := sha256.Sum256(cert.Certificate[0])
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{"system roots reject self-signed", Options{ServerName: "localhost"}, true},
+		{"skip verify", Options{ServerName: "localhost", SkipVerify: true}, false},
+		{"ca file", Options{ServerName: "localhost", CAFile: caFile}, false},
+		{"ca file wrong name", Options{ServerName: "irc.example.net", CAFile: caFile}, true},
+		{"fingerprint match", Options{ServerName: "localhost", Fingerprints: []string{hex.EncodeToString(sum[:])}}, false},
+		{"fingerprint mismatch", Options{ServerName: "localhost", Fingerprints: []string{hex.EncodeToString(make([]byte, 32))}}, true},
+		{"spki pin match", Options{ServerName: "localhost", SPKIPins: []string{"sha256/" + base64.StdEncoding.EncodeToString(spki[:])}}, false},
+		{"spki pin mismatch", Options{ServerName: "localhost", SPKIPins: []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}}, true},
+		{"either pin matches", Options{ServerName: "localhost", Fingerprints: []string{hex.EncodeToString(make([]byte, 32))}, SPKIPins: []string{base64.StdEncoding.EncodeToString(spki[:])}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Config(&tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := handshake(cert, cfg); (err != nil) != tt.wantErr {
+				t.Errorf("handshake err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	hexFP := "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	if _, err := ParseFingerprint(hexFP); err != nil {
+		t.Error(err)
+	}
+	colons := ""
+	for i := 0; i < len(hexFP); i += 2 {
+		if i > 0 {
+			colons += ":"
+		}
+		colons += hexFP[i : i+2]
+	}
+	if _, err := ParseFingerprint(colons); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseFingerprint("abcd"); err == nil {
+		t.Error("expected error for short fingerprint")
+	}
+	if _, err := ParseFingerprint("zz"); err == nil {
+		t.Error("expected error for non-hex fingerprint")
+	}
+}
+
+func TestParseSPKIPin(t *testing.T) {
+	pin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	for _, s := range []string{pin, "sha256/" + pin} {
+		if _, err := ParseSPKIPin(s); err != nil {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+	if _, err := ParseSPKIPin("sha256/AAAA"); err == nil {
+		t.Error("expected error for short pin")
+	}
+}
@@ -0,0 +1,368 @@
+// Package transfer keeps a registry of the relay sessions a bot has in flight, so commands can list
+// and cancel them and metrics can count them.
+package transfer
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Direction is which way a transfer goes, from the user's point of view.
+type Direction string
+
+const (
+	Download Direction = "download" // bot sends to the user
+	Upload   Direction = "upload"   // user sends to the bot
+)
+
+// State is where a transfer is in its life.
+type State string
+
+const (
+	Waiting   State = "waiting"   // registered on the relay; no data yet
+	Active    State = "active"    // data is flowing
+	Done      State = "done"      // completed
+	Failed    State = "failed"    // ended with an error
+	Cancelled State = "cancelled" // closed by Cancel
+)
+
+// ShortID is how many characters of the session ID are shown to users; Get accepts any unique prefix.
+const ShortID = 8
+
+// ErrAmbiguous is returned by Get when an ID prefix matches more than one transfer.
+var ErrAmbiguous = errors.New("ambiguous transfer id")
+
+// Transfer is one relay session. Its fields are fixed when it starts; the owner's nick, the byte
+// count and the state change as it runs and are safe to read concurrently.
+type Transfer struct {
+	ID        string // relay session ID
+	Owner     string // who started it, e.g. a services account or ident@host; survives nick changes
+	File      string
+	Direction Direction
+	Offset    int64 // resume position the transfer started at
+	Size      int64 // total file size, or -1 if unknown
+	Start     time.Time
+
+	bytes  atomic.Int64
+	cancel func() error
+
+	mu        sync.Mutex
+	nick      string
+	state     State
+	err       error
+	first     time.Time // first byte
+	end       time.Time
+	cancelled bool
+}
+
+// Short returns the first ShortID characters of the ID.
+func (t *Transfer) Short() string {
+	if len(t.ID) > ShortID {
+		return t.ID[:ShortID]
+	}
+	return t.ID
+}
+
+// Nick returns the owner's current nick, or "" once they have quit.
+func (t *Transfer) Nick() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.nick
+}
+
+// Add records n more bytes transferred.
+func (t *Transfer) Add(n int64) {
+	if n <= 0 {
+		return
+	}
+	t.bytes.Add(n)
+	t.mu.Lock()
+	if t.state == Waiting {
+		t.state = Active
+		t.first = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+// Bytes returns the bytes transferred so far in this session (not counting Offset).
+func (t *Transfer) Bytes() int64 {
+	return t.bytes.Load()
+}
+
+// State returns the current state.
+func (t *Transfer) State() State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// Err returns why the transfer failed, or nil.
+func (t *Transfer) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Elapsed returns how long the transfer has been running, or ran.
+func (t *Transfer) Elapsed() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.end.IsZero() {
+		return t.end.Sub(t.Start)
+	}
+	return time.Since(t.Start)
+}
+
+// Duration returns how long data has been flowing: from the first byte to the end, or to now while
+// the transfer runs. It is zero before the first byte.
+func (t *Transfer) Duration() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.first.IsZero():
+		return 0
+	case !t.end.IsZero():
+		return t.end.Sub(t.first)
+	}
+	return time.Since(t.first)
+}
+
+// Rate returns the average bytes per second over Duration, or 0 before the first byte.
+func (t *Transfer) Rate() float64 {
+	d := t.Duration()
+	if d <= 0 {
+		return 0
+	}
+	return float64(t.Bytes()) / d.Seconds()
+}
+
+// Remaining returns the bytes left to transfer, or -1 if the size is unknown.
+func (t *Transfer) Remaining() int64 {
+	if t.Size < 0 {
+		return -1
+	}
+	if n := t.Size - t.Offset - t.Bytes(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// Cancel closes the transfer's relay session; the transfer then ends as Cancelled.
+func (t *Transfer) Cancel() error {
+	t.mu.Lock()
+	t.cancelled = true
+	t.mu.Unlock()
+	return t.cancel()
+}
+
+// Reader returns r counting what is read through it toward t.
+func (t *Transfer) Reader(r io.Reader) io.Reader {
+	return &countReader{r: r, t: t}
+}
+
+type countReader struct {
+	r io.Reader
+	t *Transfer
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.t.Add(int64(n))
+	return n, err
+}
+
+// Totals counts finished transfers.
+type Totals struct {
+	Downloads     int   `json:"downloads"`      // completed downloads
+	Uploads       int   `json:"uploads"`        // completed uploads
+	Failed        int   `json:"failed"`         // transfers that ended with an error
+	Cancelled     int   `json:"cancelled"`      // transfers closed by Cancel
+	BytesSent     int64 `json:"bytes_sent"`     // download bytes
+	BytesReceived int64 `json:"bytes_received"` // upload bytes
+}
+
+// Registry tracks running transfers. It is safe for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	running map[string]*Transfer
+	totals  Totals
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{running: make(map[string]*Transfer)}
+}
+
+// Start registers a transfer for owner, whose nick is nick. cancel closes its relay session. Call
+// Finish when it ends.
+func (r *Registry) Start(id, owner, nick, file string, dir Direction, offset, size int64, cancel func() error) *Transfer {
+	t := &Transfer{
+		ID:        id,
+		Owner:     owner,
+		nick:      nick,
+		File:      file,
+		Direction: dir,
+		Offset:    offset,
+		Size:      size,
+		Start:     time.Now(),
+		cancel:    cancel,
+		state:     Waiting,
+	}
+	r.mu.Lock()
+	r.running[id] = t
+	r.mu.Unlock()
+	return t
+}
+
+// Finish removes t from the registry and counts it: Cancelled if Cancel was called, Failed if err
+// is not nil, otherwise Done.
+func (r *Registry) Finish(t *Transfer, err error) {
+	t.mu.Lock()
+	switch {
+	case t.cancelled:
+		t.state = Cancelled
+	case err != nil:
+		t.state = Failed
+	default:
+		t.state = Done
+	}
+	t.err = err
+	t.end = time.Now()
+	state := t.state
+	t.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running[t.ID] != t {
+		return
+	}
+	delete(r.running, t.ID)
+	switch {
+	case state == Cancelled:
+		r.totals.Cancelled++
+	case state == Failed:
+		r.totals.Failed++
+	case t.Direction == Upload:
+		r.totals.Uploads++
+	default:
+		r.totals.Downloads++
+	}
+	if t.Direction == Upload {
+		r.totals.BytesReceived += t.Bytes()
+	} else {
+		r.totals.BytesSent += t.Bytes()
+	}
+}
+
+// Rename follows a nick change from one nick to another in the running transfers; to is "" when
+// the user quit.
+func (r *Registry) Rename(from, to string) {
+	for _, t := range r.List() {
+		t.mu.Lock()
+		if strings.EqualFold(t.nick, from) {
+			t.nick = to
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Get returns the running transfer whose ID is id or starts with it; nil if there is none.
+func (r *Registry) Get(id string) (*Transfer, error) {
+	if id == "" {
+		return nil, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t := r.running[id]; t != nil {
+		return t, nil
+	}
+	var found *Transfer
+	for tid, t := range r.running {
+		if strings.HasPrefix(tid, id) {
+			if found != nil {
+				return nil, ErrAmbiguous
+			}
+			found = t
+		}
+	}
+	return found, nil
+}
+
+// List returns the running transfers, oldest first.
+func (r *Registry) List() []*Transfer {
+	r.mu.Lock()
+	list := make([]*Transfer, 0, len(r.running))
+	for _, t := range r.running {
+		list = append(list, t)
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Start.Equal(list[j].Start) {
+			return list[i].Start.Before(list[j].Start)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Totals returns the counts of finished transfers. Bytes include running transfers.
+func (r *Registry) Totals() Totals {
+	r.mu.Lock()
+	tot := r.totals
+	running := make([]*Transfer, 0, len(r.running))
+	for _, t := range r.running {
+		running = append(running, t)
+	}
+	r.mu.Unlock()
+	for _, t := range running {
+		if t.Direction == Upload {
+			tot.BytesReceived += t.Bytes()
+		} else {
+			tot.BytesSent += t.Bytes()
+		}
+	}
+	return tot
+}
+
+// Info is a snapshot of a transfer for metrics.
+type Info struct {
+	ID        string    `json:"id"`
+	Nick      string    `json:"nick"`
+	File      string    `json:"file"`
+	Direction Direction `json:"direction"`
+	State     State     `json:"state"`
+	Offset    int64     `json:"offset"`
+	Bytes     int64     `json:"bytes"`
+	Size      int64     `json:"size"`
+	Start     time.Time `json:"start"`
+}
+
+// Metrics is a snapshot of a Registry, e.g. for expvar.
+type Metrics struct {
+	Running []Info `json:"running"`
+	Totals  Totals `json:"totals"`
+}
+
+// Metrics returns a snapshot of the registry.
+func (r *Registry) Metrics() Metrics {
+	m := Metrics{Running: []Info{}, Totals: r.Totals()}
+	for _, t := range r.List() {
+		m.Running = append(m.Running, Info{
+			ID:        t.ID,
+			Nick:      t.Nick(),
+			File:      t.File,
+			Direction: t.Direction,
+			State:     t.State(),
+			Offset:    t.Offset,
+			Bytes:     t.Bytes(),
+			Size:      t.Size,
+			Start:     t.Start,
+		})
+	}
+	return m
+}
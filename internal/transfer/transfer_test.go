@@ -0,0 +1,107 @@
+package transfer
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	r := NewRegistry()
+	closed := false
+	tr := r.Start("abcdef0123456789", "alice", "alice", "a.txt", Download, 0, 10, func() error { closed = true; return nil })
+	if tr.State() != Waiting || tr.Short() != "abcdef01" {
+		t.Errorf("state %s, short %s", tr.State(), tr.Short())
+	}
+	io.Copy(io.Discard, tr.Reader(strings.NewReader("12345")))
+	if tr.State() != Active || tr.Bytes() != 5 || r.Totals().BytesSent != 5 {
+		t.Errorf("state %s, bytes %d, totals %+v", tr.State(), tr.Bytes(), r.Totals())
+	}
+	if got, err := r.Get("abc"); got != tr || err != nil {
+		t.Errorf("Get(prefix) = %v, %v", got, err)
+	}
+	if err := tr.Cancel(); err != nil || !closed {
+		t.Fatalf("Cancel: %v, closed %v", err, closed)
+	}
+	r.Finish(tr, errors.New("use of closed connection"))
+	if tr.State() != Cancelled || len(r.List()) != 0 {
+		t.Errorf("state %s, running %d", tr.State(), len(r.List()))
+	}
+	want := Totals{Cancelled: 1, BytesSent: 5}
+	if got := r.Totals(); got != want {
+		t.Errorf("totals %+v, want %+v", got, want)
+	}
+}
+
+func TestTotals(t *testing.T) {
+	r := NewRegistry()
+	for i, tc := range []struct {
+		dir Direction
+		err error
+	}{{Download, nil}, {Upload, nil}, {Upload, nil}, {Upload, errors.New("eof")}} {
+		tr := r.Start(string(rune('a'+i)), "bob", "bob", "f", tc.dir, 0, -1, func() error { return nil })
+		tr.Add(10)
+		r.Finish(tr, tc.err)
+		// Finishing twice does not count twice.
+		r.Finish(tr, tc.err)
+	}
+	want := Totals{Downloads: 1, Uploads: 2, Failed: 1, BytesSent: 10, BytesReceived: 30}
+	if got := r.Totals(); got != want {
+		t.Errorf("totals %+v, want %+v", got, want)
+	}
+}
+
+func TestGet(t *testing.T) {
+	r := NewRegistry()
+	a := r.Start("aa11", "x", "x", "f", Upload, 0, -1, nil)
+	r.Start("aa22", "x", "x", "f", Upload, 0, -1, nil)
+	if _, err := r.Get("aa"); !errors.Is(err, ErrAmbiguous) {
+		t.Errorf("ambiguous prefix: %v", err)
+	}
+	if got, _ := r.Get("aa1"); got != a {
+		t.Errorf("Get(aa1) = %v", got)
+	}
+	if got, err := r.Get("b"); got != nil || err != nil {
+		t.Errorf("Get(b) = %v, %v", got, err)
+	}
+	if m := r.Metrics(); len(m.Running) != 2 || m.Running[0].State != Waiting {
+		t.Errorf("metrics %+v", m)
+	}
+}
+
+func TestRename(t *testing.T) {
+	r := NewRegistry()
+	a := r.Start("r1", "alice@host", "alice", "a", Download, 0, -1, nil)
+	b := r.Start("r2", "bob@host", "bob", "b", Download, 0, -1, nil)
+	r.Rename("ALICE", "alice_")
+	if a.Nick() != "alice_" || a.Owner != "alice@host" || b.Nick() != "bob" {
+		t.Errorf("after rename: %q (%q), %q", a.Nick(), a.Owner, b.Nick())
+	}
+	r.Rename("bob", "")
+	if b.Nick() != "" {
+		t.Errorf("after quit: %q", b.Nick())
+	}
+}
+
+func TestProgress(t *testing.T) {
+	r := NewRegistry()
+	tr := r.Start("p1", "alice", "alice", "a.txt", Download, 40, 100, func() error { return nil })
+	if tr.Duration() != 0 || tr.Rate() != 0 || tr.Remaining() != 60 {
+		t.Errorf("before data: duration %v, rate %v, remaining %d", tr.Duration(), tr.Rate(), tr.Remaining())
+	}
+	tr.Add(50)
+	time.Sleep(10 * time.Millisecond)
+	r.Finish(tr, nil)
+	d := tr.Duration()
+	if d < 10*time.Millisecond || tr.Duration() != d || tr.Remaining() != 10 {
+		t.Errorf("after finish: duration %v then %v, remaining %d", d, tr.Duration(), tr.Remaining())
+	}
+	if rate := tr.Rate(); rate <= 0 || rate > 5000 {
+		t.Errorf("rate %v", rate)
+	}
+	if u := r.Start("p2", "bob", "bob", "b", Upload, 0, -1, nil); u.Remaining() != -1 {
+		t.Errorf("unknown size: remaining %d", u.Remaining())
+	}
+}
@@ -1,17 +1,20 @@
 package turnclient
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/url"
-	"strconv"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/awgh/huzaa-bot/internal/ratelimit"
 	"github.com/awgh/huzaa-bot/internal/relayprotocol"
 )
 
@@ -29,42 +32,185 @@ func GenerateSessionID() (string, error) {
 
 // Client connects to the relay over TLS and performs session register + stream.
 type Client struct {
-	relayHost   string
-	relayPort   int
-	tlsConfig   *tls.Config
+	// LegacyAuth allows falling back to MsgAuth, which sends the raw secret, when the relay does not
+	// support challenge-response auth or predates MsgHello.
+	LegacyAuth bool
+	// DialTimeout bounds connecting, the TLS handshake, authentication and registration (default
+	// DefaultDialTimeout; negative: no bound beyond the caller's context).
+	DialTimeout time.Duration
+	// AcceptTimeout is how long a registered session waits for the user's client to connect
+	// (default DefaultAcceptTimeout; negative: forever). An upload fails with ErrAcceptTimeout if
+	// no data arrives in that time. A download cannot tell, because the relay simply stops taking
+	// data until the client connects, so a stalled write fails at the later of the accept deadline
+	// and the idle timeout.
+	AcceptTimeout time.Duration
+	// IdleTimeout aborts a session with ErrIdleTimeout once data has stopped flowing for that
+	// long (default DefaultIdleTimeout; negative: never).
+	IdleTimeout time.Duration
+	// Selection is how a session picks among several relays (default Priority).
+	Selection Selection
+
 	authUsername string
 	authSecret   string
+
+	mu     sync.Mutex
+	relays []*relay
+	next   int // next relay to start from, for RoundRobin
 }
 
+// Timeouts used when the Client's fields are zero.
+const (
+	DefaultDialTimeout   = 10 * time.Second
+	DefaultAcceptTimeout = 10 * time.Minute
+	DefaultIdleTimeout   = 5 * time.Minute
+)
+
+// Errors returned when a session times out.
+var (
+	ErrAcceptTimeout = errors.New("relay: the client did not connect in time")
+	ErrIdleTimeout   = errors.New("relay: the transfer stalled")
+)
+
+// errHelloUnsupported means the relay rejected MsgHello, i.e. it predates protocol negotiation.
+var errHelloUnsupported = errors.New("relay does not support protocol negotiation (huzaa-relay too old?)")
+
+// RelayError is an error the relay reported for a session, e.g. that the peer went away.
+type RelayError string
+
+func (e RelayError) Error() string { return "relay: " + string(e) }
+
 // NewClient creates a relay client. turnURL is e.g. "turns://irc.example.com:5349".
-// username and secret are optional; when both are set, the client sends MsgAuth after each dial (for relays with turn_users).
+// username and secret must match one of the relay's turn_users; they are checked after each dial.
+// tlsConfig may be nil for the system roots; a config without ServerName is copied and given the relay host.
 func NewClient(turnURL string, tlsConfig *tls.Config, username, secret string) (*Client, error) {
-	u, err := url.Parse(turnURL)
+	return NewFailoverClient([]string{turnURL}, tlsConfig, username, secret)
+}
+
+// NewFailoverClient creates a client for several relays sharing the same credentials and TLS
+// settings. Each session is registered on the first relay that works, in the order Selection
+// gives; see CheckHealth.
+func NewFailoverClient(turnURLs []string, tlsConfig *tls.Config, username, secret string) (*Client, error) {
+	if len(turnURLs) == 0 {
+		return nil, errors.New("no relay URLs")
+	}
+	c := &Client{authUsername: username, authSecret: secret}
+	for _, turnURL := range turnURLs {
+		r, err := parseRelay(turnURL, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		c.relays = append(c.relays, r)
+	}
+	return c, nil
+}
+
+// connect dials r, negotiates the protocol and authenticates, giving up when ctx is done.
+// It returns the features both sides support. Relays that predate MsgHello are used (with legacy
+// auth) only if LegacyAuth is set.
+func (c *Client) connect(ctx context.Context, r *relay) (*tls.Conn, uint32, error) {
+	conn, features, err := c.dial(ctx, r)
+	if errors.Is(err, errHelloUnsupported) && c.LegacyAuth {
+		if conn, err = r.dialTLS(ctx); err != nil {
+			return nil, 0, err
+		}
+		if err := during(ctx, conn, func() error { return c.legacyAuth(conn) }); err != nil {
+			conn.Close()
+			return nil, 0, err
+		}
+		return conn, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	err = during(ctx, conn, func() error {
+		switch {
+		case features&relayprotocol.FeatureChallengeAuth != 0:
+			return c.auth(conn)
+		case c.LegacyAuth:
+			return c.legacyAuth(conn)
+		}
+		return errors.New("relay does not support challenge-response auth; set RelayLegacyAuth to send the secret instead")
+	})
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	return conn, features, nil
+}
+
+// during runs fn, which does I/O on conn, so that the I/O fails once ctx is done, and then
+// returns ctx's error instead of the I/O error.
+func during(ctx context.Context, conn net.Conn, fn func() error) error {
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	err := fn()
+	stop()
+	if ctx.Err() != nil {
+		return fmt.Errorf("relay: %w", ctx.Err())
+	}
+	return err
+}
+
+// hello exchanges MsgHello frames and returns the features both sides support.
+func hello(rw io.ReadWriter) (uint32, error) {
+	ours := relayprotocol.Hello{Version: relayprotocol.ProtocolVersion, Features: relayprotocol.Features}
+	if err := relayprotocol.WriteFrame(rw, relayprotocol.MsgHello, ours.Marshal()); err != nil {
+		return 0, err
+	}
+	msgType, payload, err := relayprotocol.ReadFrame(rw)
+	if err != nil {
+		return 0, err
+	}
+	if msgType == relayprotocol.MsgError {
+		return 0, fmt.Errorf("%w: %s", errHelloUnsupported, string(payload))
+	}
+	if msgType != relayprotocol.MsgHello {
+		return 0, fmt.Errorf("relay: unexpected response to hello (type %d)", msgType)
+	}
+	theirs, err := relayprotocol.ParseHello(payload)
+	if err != nil {
+		return 0, fmt.Errorf("relay: %w", err)
+	}
+	if theirs.Version < relayprotocol.MinProtocolVersion {
+		return 0, fmt.Errorf("relay speaks protocol version %d, need at least %d; upgrade huzaa-relay",
+			theirs.Version, relayprotocol.MinProtocolVersion)
+	}
+	return ours.Features & theirs.Features, nil
+}
+
+// auth performs challenge-response auth: MsgAuthHello (username), MsgAuthChallenge (nonce),
+// MsgAuthResponse (HMAC of the nonce with the secret), then MsgAuthOk or MsgError.
+func (c *Client) auth(rw io.ReadWriter) error {
+	if c.authUsername == "" || c.authSecret == "" {
+		return fmt.Errorf("relay auth: username and secret required")
+	}
+	if err := relayprotocol.WriteFrame(rw, relayprotocol.MsgAuthHello, []byte(c.authUsername)); err != nil {
+		return err
+	}
+	msgType, nonce, err := relayprotocol.ReadFrame(rw)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	port := 5349
-	if u.Port() != "" {
-		port, _ = strconv.Atoi(u.Port())
+	if msgType == relayprotocol.MsgError {
+		return fmt.Errorf("relay auth: %s", string(nonce))
+	}
+	if msgType != relayprotocol.MsgAuthChallenge {
+		return fmt.Errorf("relay: unexpected response to auth hello (type %d)", msgType)
 	}
-	host := u.Hostname()
-	if host == "" {
-		return nil, fmt.Errorf("missing host in %s", turnURL)
+	if len(nonce) < relayprotocol.NonceSize {
+		return fmt.Errorf("relay auth: challenge too short (%d bytes)", len(nonce))
 	}
-	if tlsConfig == nil {
-		tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	mac := relayprotocol.AuthMAC(c.authSecret, c.authUsername, nonce)
+	if err := relayprotocol.WriteFrame(rw, relayprotocol.MsgAuthResponse, mac); err != nil {
+		return err
 	}
-	return &Client{
-		relayHost:     host,
-		relayPort:     port,
-		tlsConfig:     tlsConfig,
-		authUsername:  username,
-		authSecret:    secret,
-	}, nil
+	return readAuthResult(rw)
 }
 
-// auth sends MsgAuth (username + secret) and waits for MsgAuthOk or MsgError. Required for all relay connections.
-func (c *Client) auth(conn *tls.Conn) error {
+// legacyAuth sends MsgAuth (username + secret) and waits for MsgAuthOk or MsgError.
+func (c *Client) legacyAuth(rw io.ReadWriter) error {
 	if c.authUsername == "" || c.authSecret == "" {
 		return fmt.Errorf("relay auth: username and secret required")
 	}
@@ -73,10 +219,15 @@ func (c *Client) auth(conn *tls.Conn) error {
 	binary.BigEndian.PutUint32(payload[:4], uint32(len(un)))
 	copy(payload[4:], un)
 	copy(payload[4+len(un):], c.authSecret)
-	if err := relayprotocol.WriteFrame(conn, relayprotocol.MsgAuth, payload); err != nil {
+	if err := relayprotocol.WriteFrame(rw, relayprotocol.MsgAuth, payload); err != nil {
 		return err
 	}
-	msgType, resp, err := relayprotocol.ReadFrame(conn)
+	return readAuthResult(rw)
+}
+
+// readAuthResult waits for MsgAuthOk or MsgError.
+func readAuthResult(r io.Reader) error {
+	msgType, resp, err := relayprotocol.ReadFrame(r)
 	if err != nil {
 		return err
 	}
@@ -89,13 +240,122 @@ func (c *Client) auth(conn *tls.Conn) error {
 	return nil
 }
 
+// dialTimeout returns the bound on setting up a session, or 0 if there is none.
+func (c *Client) dialTimeout() time.Duration {
+	switch {
+	case c.DialTimeout == 0:
+		return DefaultDialTimeout
+	case c.DialTimeout < 0:
+		return 0
+	}
+	return c.DialTimeout
+}
+
+// dialContext returns ctx bounded by the dial timeout, if there is one.
+func (c *Client) dialContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d := c.dialTimeout(); d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// timeouts returns the timeouts of a session registered now.
+func (c *Client) timeouts() timeouts {
+	t := timeouts{idle: c.IdleTimeout}
+	if t.idle == 0 {
+		t.idle = DefaultIdleTimeout
+	}
+	accept := c.AcceptTimeout
+	if accept == 0 {
+		accept = DefaultAcceptTimeout
+	}
+	if accept > 0 {
+		t.accept = time.Now().Add(accept)
+	}
+	return t
+}
+
+// timeouts are a session's accept deadline and idle timeout.
+type timeouts struct {
+	accept time.Time     // zero: wait forever for the client
+	idle   time.Duration // <= 0: never idle out
+}
+
+// write returns the deadline for a download write and the error to report if it passes.
+func (t timeouts) write() (time.Time, error) {
+	if t.idle <= 0 {
+		return time.Time{}, nil
+	}
+	dl := time.Now().Add(t.idle)
+	if t.accept.After(dl) {
+		return t.accept, ErrAcceptTimeout
+	}
+	return dl, ErrIdleTimeout
+}
+
+// read returns the deadline for an upload read and the error to report if it passes; connected
+// says whether data has arrived yet.
+func (t timeouts) read(connected bool) (time.Time, error) {
+	if !connected {
+		return t.accept, ErrAcceptTimeout
+	}
+	if t.idle <= 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(t.idle), ErrIdleTimeout
+}
+
 // DownloadSession holds the connection for a download after RegisterDownload.
 type DownloadSession struct {
-	conn *tls.Conn
+	conn     *tls.Conn
+	close    closer
+	limiters []*ratelimit.Limiter
+	timeouts timeouts
+}
+
+// closer closes a session's connection once, so Close can abort a transfer from another goroutine,
+// and closes done so a throttled transfer stops waiting.
+type closer struct {
+	once sync.Once
+	err  error
+	done chan struct{}
+}
+
+func newCloser() closer {
+	return closer{done: make(chan struct{})}
+}
+
+func (c *closer) close(conn *tls.Conn) error {
+	c.once.Do(func() {
+		close(c.done)
+		c.err = conn.Close()
+	})
+	return c.err
+}
+
+// SetLimiters throttles SendFile: each chunk waits for tokens (bytes) from every limiter, e.g. a
+// global, a per-user and a per-transfer one. Call it before SendFile.
+func (d *DownloadSession) SetLimiters(lims ...*ratelimit.Limiter) {
+	d.limiters = lims
 }
 
 // SendFile streams the file content to the relay.
 func (d *DownloadSession) SendFile(content io.Reader, maxBytes int64) error {
+	return d.SendFileContext(context.Background(), content, maxBytes)
+}
+
+// SendFileContext is SendFile; cancelling ctx aborts the session, as Close does, and returns ctx's error.
+func (d *DownloadSession) SendFileContext(ctx context.Context, content io.Reader, maxBytes int64) error {
+	stop := context.AfterFunc(ctx, func() { d.Close() })
+	defer stop()
+	err := d.sendFile(content, maxBytes)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (d *DownloadSession) sendFile(content io.Reader, maxBytes int64) error {
 	buf := make([]byte, 32*1024)
 	var sent int64
 	for {
@@ -107,7 +367,10 @@ func (d *DownloadSession) SendFile(content io.Reader, maxBytes int64) error {
 			// Copy payload so we don't reuse buf before the write is flushed to the network.
 			payload := make([]byte, n)
 			copy(payload, buf[:n])
-			if err := relayprotocol.WriteFrame(d.conn, relayprotocol.MsgData, payload); err != nil {
+			if !ratelimit.WaitAll(n, d.close.done, d.limiters...) {
+				return net.ErrClosed
+			}
+			if err := d.write(relayprotocol.MsgData, payload); err != nil {
 				return err
 			}
 			sent += int64(n)
@@ -128,79 +391,96 @@ func (d *DownloadSession) SendFile(content io.Reader, maxBytes int64) error {
 	if Debug {
 		log.Printf("[debug] SendFile sending EOF, total %d bytes", sent)
 	}
-	return relayprotocol.WriteFrame(d.conn, relayprotocol.MsgEOF, nil)
+	return d.write(relayprotocol.MsgEOF, nil)
+}
+
+// write sends one frame, failing with ErrAcceptTimeout or ErrIdleTimeout if the relay does not take it in time.
+func (d *DownloadSession) write(msgType byte, payload []byte) error {
+	dl, timeoutErr := d.timeouts.write()
+	d.conn.SetWriteDeadline(dl)
+	err := relayprotocol.WriteFrame(d.conn, msgType, payload)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return timeoutErr
+	}
+	return err
 }
 
-// Close closes the session connection.
+// Close closes the session connection. It may be called while SendFile runs, to abort it.
 func (d *DownloadSession) Close() error {
-	if d.conn != nil {
-		err := d.conn.Close()
-		d.conn = nil
-		return err
-	}
-	return nil
+	return d.close.close(d.conn)
 }
 
-// RegisterDownload registers a download session and returns the relay host, port, and a session to stream the file.
+// RegisterDownload registers a download session and returns the host and port of the relay it is
+// on, and a session to stream the file.
 func (c *Client) RegisterDownload(sessionID, filename string) (host string, port int, sess *DownloadSession, err error) {
-	conn, err := c.dial()
-	if err != nil {
-		return "", 0, nil, err
-	}
-	if err := c.auth(conn); err != nil {
-		conn.Close()
-		return "", 0, nil, err
-	}
-	payload := make([]byte, 0, 36+len(filename))
-	if len(sessionID) > 36 {
-		sessionID = sessionID[:36]
-	}
-	payload = append(payload, []byte(sessionID)...)
-	for len(payload) < 36 {
-		payload = append(payload, 0)
-	}
-	payload = append(payload, filename...)
+	return c.RegisterDownloadContext(context.Background(), sessionID, filename)
+}
 
-	if err := relayprotocol.WriteFrame(conn, relayprotocol.MsgRegisterDownload, payload); err != nil {
-		conn.Close()
-		return "", 0, nil, err
-	}
-	msgType, resp, err := relayprotocol.ReadFrame(conn)
+// RegisterDownloadContext is RegisterDownload, giving up when ctx is done or after DialTimeout per relay.
+func (c *Client) RegisterDownloadContext(ctx context.Context, sessionID, filename string) (host string, port int, sess *DownloadSession, err error) {
+	host, conn, port, err := c.register(ctx, relayprotocol.MsgRegisterDownload, sessionID, filename)
 	if err != nil {
-		conn.Close()
 		return "", 0, nil, err
 	}
-	if msgType == relayprotocol.MsgError {
-		conn.Close()
-		return "", 0, nil, fmt.Errorf("relay: %s", string(resp))
-	}
-	if msgType != relayprotocol.MsgPortAlloc || len(resp) < 4 {
-		conn.Close()
-		return "", 0, nil, fmt.Errorf("relay: unexpected response")
-	}
-	port = int(binary.BigEndian.Uint32(resp))
-	return c.relayHost, port, &DownloadSession{conn: conn}, nil
+	return host, port, &DownloadSession{conn: conn, close: newCloser(), timeouts: c.timeouts()}, nil
 }
 
 // UploadStream implements io.Reader for upload data from the relay.
 type UploadStream struct {
-	conn *tls.Conn
-	buf  []byte
-	eof  bool
+	conn      *tls.Conn
+	buf       []byte
+	eof       bool
+	connected bool // data has arrived
+	close     closer
+	limiters  []*ratelimit.Limiter
+	timeouts  timeouts
+}
+
+// SetLimiters throttles Read: each read waits for tokens (bytes) from every limiter. Slowing the
+// reads pushes back on the relay and the sender. Call it before reading.
+func (u *UploadStream) SetLimiters(lims ...*ratelimit.Limiter) {
+	u.limiters = lims
 }
 
+// Read returns the uploaded bytes. It returns io.EOF only after the relay's MsgEOF; if the relay
+// connection closes first it returns io.ErrUnexpectedEOF.
 func (u *UploadStream) Read(p []byte) (n int, err error) {
+	return u.ReadContext(context.Background(), p)
+}
+
+// ReadContext is Read; cancelling ctx aborts the upload, as Close does, and returns ctx's error.
+func (u *UploadStream) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	stop := context.AfterFunc(ctx, func() { u.Close() })
+	defer stop()
+	n, err = u.read(p)
+	if err != nil && err != io.EOF && ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+	return n, err
+}
+
+func (u *UploadStream) read(p []byte) (n int, err error) {
 	for len(u.buf) == 0 && !u.eof {
+		dl, timeoutErr := u.timeouts.read(u.connected)
+		u.conn.SetReadDeadline(dl)
 		msgType, payload, err := relayprotocol.ReadFrame(u.conn)
+		if err == io.EOF {
+			// Only MsgEOF marks a complete upload; a closed connection means it was cut short.
+			err = io.ErrUnexpectedEOF
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, timeoutErr
+		}
 		if err != nil {
 			return 0, err
 		}
+		u.connected = true
 		if msgType == relayprotocol.MsgEOF {
 			u.eof = true
 			return 0, io.EOF
 		}
 		if msgType == relayprotocol.MsgError {
-			return 0, fmt.Errorf("relay: %s", string(payload))
+			return 0, RelayError(payload)
 		}
 		if msgType != relayprotocol.MsgData {
 			return 0, fmt.Errorf("relay: unexpected msg type %d", msgType)
@@ -212,27 +492,67 @@ func (u *UploadStream) Read(p []byte) (n int, err error) {
 	}
 	n = copy(p, u.buf)
 	u.buf = u.buf[n:]
+	if !ratelimit.WaitAll(n, u.close.done, u.limiters...) {
+		return n, net.ErrClosed
+	}
 	return n, nil
 }
 
+// Close closes the stream's connection. It may be called while Read runs, to abort the upload.
 func (u *UploadStream) Close() error {
-	if u.conn != nil {
-		err := u.conn.Close()
-		u.conn = nil
-		return err
-	}
-	return nil
+	return u.close.close(u.conn)
 }
 
 // RegisterUploadStream registers upload and returns a stream to read the uploaded file.
 func (c *Client) RegisterUploadStream(sessionID, filename string) (host string, port int, stream *UploadStream, err error) {
-	conn, err := c.dial()
+	return c.RegisterUploadStreamContext(context.Background(), sessionID, filename)
+}
+
+// RegisterUploadStreamContext is RegisterUploadStream, giving up when ctx is done or after DialTimeout per relay.
+func (c *Client) RegisterUploadStreamContext(ctx context.Context, sessionID, filename string) (host string, port int, stream *UploadStream, err error) {
+	host, conn, port, err := c.register(ctx, relayprotocol.MsgRegisterUpload, sessionID, filename)
 	if err != nil {
 		return "", 0, nil, err
 	}
-	if err := c.auth(conn); err != nil {
-		conn.Close()
-		return "", 0, nil, err
+	return host, port, &UploadStream{conn: conn, close: newCloser(), timeouts: c.timeouts()}, nil
+}
+
+// register registers a session with msgType (MsgRegisterDownload or MsgRegisterUpload) on the
+// first relay that works, returning its host, the connection and the port the peer connects to.
+func (c *Client) register(ctx context.Context, msgType byte, sessionID, filename string) (string, *tls.Conn, int, error) {
+	var err error
+	var last *relay
+	for _, r := range c.candidates() {
+		var conn *tls.Conn
+		var port int
+		conn, port, err = c.registerOn(ctx, r, msgType, sessionID, filename)
+		if ctx.Err() != nil {
+			// Cancelled by the caller: not the relay's fault.
+			return "", nil, 0, err
+		}
+		// A relay that answers with an error is up; only failing to reach it marks it down.
+		var relayErr RelayError
+		if !errors.As(err, &relayErr) {
+			c.mark(r, err)
+		}
+		if err == nil {
+			return r.host, conn, port, nil
+		}
+		last = r
+	}
+	if len(c.relays) > 1 {
+		err = fmt.Errorf("all %d relays failed (last %s: %w)", len(c.relays), last.host, err)
+	}
+	return "", nil, 0, err
+}
+
+// registerOn connects to r and registers a session there.
+func (c *Client) registerOn(ctx context.Context, r *relay, msgType byte, sessionID, filename string) (*tls.Conn, int, error) {
+	ctx, cancel := c.dialContext(ctx)
+	defer cancel()
+	conn, _, err := c.connect(ctx, r)
+	if err != nil {
+		return nil, 0, err
 	}
 	payload := make([]byte, 0, 36+len(filename))
 	if len(sessionID) > 36 {
@@ -244,37 +564,47 @@ func (c *Client) RegisterUploadStream(sessionID, filename string) (host string,
 	}
 	payload = append(payload, filename...)
 
-	if err := relayprotocol.WriteFrame(conn, relayprotocol.MsgRegisterUpload, payload); err != nil {
-		conn.Close()
-		return "", 0, nil, err
-	}
-	msgType, resp, err := relayprotocol.ReadFrame(conn)
+	var port int
+	err = during(ctx, conn, func() error {
+		if err := relayprotocol.WriteFrame(conn, msgType, payload); err != nil {
+			return err
+		}
+		respType, resp, err := relayprotocol.ReadFrame(conn)
+		if err != nil {
+			return err
+		}
+		if respType == relayprotocol.MsgError {
+			return RelayError(resp)
+		}
+		if respType != relayprotocol.MsgPortAlloc || len(resp) < 4 {
+			return fmt.Errorf("relay: unexpected response")
+		}
+		port = int(binary.BigEndian.Uint32(resp))
+		return nil
+	})
 	if err != nil {
 		conn.Close()
-		return "", 0, nil, err
+		return nil, 0, err
 	}
-	if msgType == relayprotocol.MsgError {
-		conn.Close()
-		return "", 0, nil, fmt.Errorf("relay: %s", string(resp))
-	}
-	if msgType != relayprotocol.MsgPortAlloc || len(resp) < 4 {
-		conn.Close()
-		return "", 0, nil, fmt.Errorf("relay: unexpected response")
-	}
-	port = int(binary.BigEndian.Uint32(resp))
-	return c.relayHost, port, &UploadStream{conn: conn}, nil
+	// The session's own timeouts take over from here.
+	conn.SetDeadline(time.Time{})
+	return conn, port, nil
 }
 
-func (c *Client) dial() (*tls.Conn, error) {
-	addr := fmt.Sprintf("%s:%d", c.relayHost, c.relayPort)
-	tcpConn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+// dial connects to r and exchanges MsgHello. It returns the features both sides support.
+func (c *Client) dial(ctx context.Context, r *relay) (*tls.Conn, uint32, error) {
+	conn, err := r.dialTLS(ctx)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	tlsConn := tls.Client(tcpConn, c.tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
-		tcpConn.Close()
-		return nil, err
+	var features uint32
+	err = during(ctx, conn, func() (err error) {
+		features, err = hello(conn)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
 	}
-	return tlsConn, nil
+	return conn, features, nil
 }
@@ -0,0 +1,434 @@
+package turnclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/awgh/huzaa-bot/internal/ratelimit"
+	"github.com/awgh/huzaa-bot/internal/relayprotocol"
+	"github.com/awgh/huzaa-bot/internal/relaytest"
+)
+
+// fakeAuthRelay runs the relay side of challenge-response auth on conn.
+func fakeAuthRelay(conn net.Conn, secret string) {
+	defer conn.Close()
+	msgType, payload, err := relayprotocol.ReadFrame(conn)
+	if err != nil {
+		return
+	}
+	switch {
+	case msgType == relayprotocol.MsgAuthHello:
+		nonce := bytes.Repeat([]byte{7}, relayprotocol.NonceSize)
+		relayprotocol.WriteFrame(conn, relayprotocol.MsgAuthChallenge, nonce)
+		msgType, mac, err := relayprotocol.ReadFrame(conn)
+		if err != nil || msgType != relayprotocol.MsgAuthResponse {
+			return
+		}
+		if relayprotocol.CheckAuthMAC(secret, string(payload), nonce, mac) {
+			relayprotocol.WriteFrame(conn, relayprotocol.MsgAuthOk, nil)
+		} else {
+			relayprotocol.WriteFrame(conn, relayprotocol.MsgError, []byte("bad credentials"))
+		}
+	default:
+		relayprotocol.WriteFrame(conn, relayprotocol.MsgError, []byte("auth required"))
+	}
+}
+
+func TestAuthChallenge(t *testing.T) {
+	for _, secret := range []string{"s3cret", "wrong"} {
+		c := &Client{authUsername: "bot", authSecret: "s3cret"}
+		client, server := net.Pipe()
+		go fakeAuthRelay(server, secret)
+		err := c.auth(client)
+		if secret == c.authSecret && err != nil {
+			t.Errorf("auth failed: %v", err)
+		}
+		if secret != c.authSecret && err == nil {
+			t.Error("auth succeeded with wrong secret")
+		}
+		client.Close()
+	}
+}
+
+func TestHello(t *testing.T) {
+	tests := []struct {
+		name         string
+		msgType      byte
+		payload      []byte
+		wantFeatures uint32
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{"same version", relayprotocol.MsgHello, relayprotocol.Hello{Version: 1, Features: relayprotocol.Features}.Marshal(), relayprotocol.Features, false, nil},
+		{"newer relay with extra features", relayprotocol.MsgHello, relayprotocol.Hello{Version: 9, Features: 0xffffffff}.Marshal(), relayprotocol.Features, false, nil},
+		{"relay without features", relayprotocol.MsgHello, relayprotocol.Hello{Version: 1}.Marshal(), 0, false, nil},
+		{"relay too old", relayprotocol.MsgHello, relayprotocol.Hello{Version: 0}.Marshal(), 0, true, nil},
+		{"relay predates hello", relayprotocol.MsgError, []byte("auth required"), 0, true, errHelloUnsupported},
+		{"garbage", relayprotocol.MsgPortAlloc, []byte{0, 0, 0, 1}, 0, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				msgType, payload, err := relayprotocol.ReadFrame(server)
+				if err != nil || msgType != relayprotocol.MsgHello {
+					return
+				}
+				if h, err := relayprotocol.ParseHello(payload); err != nil || h.Version != relayprotocol.ProtocolVersion {
+					return
+				}
+				relayprotocol.WriteFrame(server, tt.msgType, tt.payload)
+			}()
+			features, err := hello(client)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("err = %v, want %v", err, tt.wantErrIs)
+			}
+			if err == nil && features != tt.wantFeatures {
+				t.Errorf("features = %#x, want %#x", features, tt.wantFeatures)
+			}
+		})
+	}
+}
+
+func newRelay(t *testing.T, cfg *relaytest.Config) *relaytest.Server {
+	t.Helper()
+	if cfg.Users == nil {
+		cfg.Users = map[string]string{"bot": "s3cret"}
+	}
+	srv, err := relaytest.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func newTestClient(t *testing.T, srv *relaytest.Server, secret string) *Client {
+	t.Helper()
+	c, err := NewClient(srv.URL(), srv.TLSConfig(), "bot", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestDownload(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	c := newTestClient(t, srv, "s3cret")
+	host, port, sess, err := c.RegisterDownload("abc", "file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if host != "127.0.0.1" || port == 0 {
+		t.Errorf("host %q port %d", host, port)
+	}
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	errc := make(chan error, 1)
+	go func() { errc <- sess.SendFile(bytes.NewReader(content), 0) }()
+	got, err := relaytest.Fetch(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("peer received %d bytes, want %d", len(got), len(content))
+	}
+	regs := srv.Registrations()
+	if len(regs) != 1 || regs[0].SessionID != "abc" || regs[0].Filename != "file.bin" || regs[0].Upload {
+		t.Errorf("registrations = %+v", regs)
+	}
+}
+
+func TestDownloadMaxBytes(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	c := newTestClient(t, srv, "s3cret")
+	_, port, sess, err := c.RegisterDownload("abc", "file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	go sess.SendFile(bytes.NewReader([]byte("hello world")), 5)
+	got, err := relaytest.Fetch(port)
+	if err != nil || string(got) != "hello" {
+		t.Errorf("got %q %v", got, err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	c := newTestClient(t, srv, "s3cret")
+	_, port, stream, err := c.RegisterUploadStream("abc", "up.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if err := relaytest.Send(port, []byte("uploaded data")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(stream)
+	if err != nil || string(got) != "uploaded data" {
+		t.Errorf("got %q %v", got, err)
+	}
+}
+
+func TestUploadDropped(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{DropUploads: true})
+	c := newTestClient(t, srv, "s3cret")
+	_, port, stream, err := c.RegisterUploadStream("abc", "up.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if err := relaytest.Send(port, []byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(stream)
+	if err != io.ErrUnexpectedEOF || string(got) != "partial" {
+		t.Errorf("got %q %v, want io.ErrUnexpectedEOF", got, err)
+	}
+}
+
+func TestConnectAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        relaytest.Config
+		secret     string
+		legacyAuth bool
+		wantErr    bool
+	}{
+		{"challenge", relaytest.Config{}, "s3cret", false, false},
+		{"wrong secret", relaytest.Config{}, "wrong", false, true},
+		{"legacy relay refused", relaytest.Config{LegacyOnly: true}, "s3cret", false, true},
+		{"legacy relay allowed", relaytest.Config{LegacyOnly: true}, "s3cret", true, false},
+		{"legacy relay wrong secret", relaytest.Config{LegacyOnly: true}, "wrong", true, true},
+		{"relay without challenge feature", relaytest.Config{Features: 1 << 31}, "s3cret", false, true},
+		{"relay without challenge feature, legacy allowed", relaytest.Config{Features: 1 << 31}, "s3cret", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newRelay(t, &tt.cfg)
+			c := newTestClient(t, srv, tt.secret)
+			c.LegacyAuth = tt.legacyAuth
+			_, _, sess, err := c.RegisterDownload("abc", "f")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if sess != nil {
+				sess.Close()
+			}
+		})
+	}
+}
+
+func TestUntrustedRelay(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	c, err := NewClient(srv.URL(), nil, "bot", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := c.RegisterDownload("abc", "f"); err == nil {
+		t.Error("connected to relay with untrusted certificate")
+	}
+}
+
+func TestCloseAbortsUpload(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	c := newTestClient(t, srv, "s3cret")
+	_, _, stream, err := c.RegisterUploadStream("abc", "up.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(stream)
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // let Read block waiting for the peer
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Read after Close returned no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not abort Read")
+	}
+	stream.Close() // closing twice is harmless
+}
+
+func TestDownloadThrottled(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	c := newTestClient(t, srv, "s3cret")
+	_, port, sess, err := c.RegisterDownload("abc", "file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	// 64 KiB/s with a full 64 KiB bucket: 128 KiB takes about a second.
+	lim := ratelimit.New(64<<10, 64<<10)
+	sess.SetLimiters(nil, lim)
+	content := bytes.Repeat([]byte("x"), 128<<10)
+	start := time.Now()
+	go sess.SendFile(bytes.NewReader(content), 0)
+	got, err := relaytest.Fetch(port)
+	if err != nil || len(got) != len(content) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+	if d := time.Since(start); d < 800*time.Millisecond {
+		t.Errorf("throttled download took %v, want about 1s", d)
+	}
+}
+
+func TestCloseAbortsThrottledDownload(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	c := newTestClient(t, srv, "s3cret")
+	_, _, sess, err := c.RegisterDownload("abc", "file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim := ratelimit.New(1, 1)
+	lim.Reserve(1)
+	sess.SetLimiters(lim)
+	errc := make(chan error, 1)
+	go func() { errc <- sess.SendFile(bytes.NewReader([]byte("slow")), 0) }()
+	time.Sleep(50 * time.Millisecond)
+	sess.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("SendFile after Close returned no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not abort a throttled SendFile")
+	}
+}
+
+func TestRegisterTimeout(t *testing.T) {
+	// A relay that accepts connections but never completes the TLS handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	c, err := NewClient("turns://"+ln.Addr().String(), nil, "bot", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.DialTimeout = 50 * time.Millisecond
+	if _, _, _, err := c.RegisterUploadStream("abc", "f"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RegisterUploadStream: %v, want deadline exceeded", err)
+	}
+
+	c.DialTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, _, err := c.RegisterDownloadContext(ctx, "abc", "f"); !errors.Is(err, context.Canceled) {
+		t.Errorf("RegisterDownloadContext: %v, want canceled", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("cancel took %v", d)
+	}
+}
+
+func TestNoDialTimeout(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	c := newTestClient(t, srv, "s3cret")
+	c.DialTimeout = -1
+	_, _, sess, err := c.RegisterDownload("abc", "f")
+	if err != nil {
+		t.Fatalf("RegisterDownload without a dial timeout: %v", err)
+	}
+	sess.Close()
+	if h := c.CheckHealth(context.Background()); !h[0].Healthy {
+		t.Errorf("health %+v", h)
+	}
+}
+
+func TestAcceptTimeout(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	c := newTestClient(t, srv, "s3cret")
+	c.AcceptTimeout = 50 * time.Millisecond
+	_, _, stream, err := c.RegisterUploadStream("abc", "up.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := io.ReadAll(stream); !errors.Is(err, ErrAcceptTimeout) {
+		t.Errorf("Read: %v, want ErrAcceptTimeout", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	c := newTestClient(t, srv, "s3cret")
+	c.IdleTimeout = 100 * time.Millisecond
+	_, port, stream, err := c.RegisterUploadStream("abc", "up.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	// The client sends a little, then stalls without disconnecting.
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.Write([]byte("abc"))
+	got, err := io.ReadAll(stream)
+	if string(got) != "abc" || !errors.Is(err, ErrIdleTimeout) {
+		t.Errorf("got %q, %v; want abc, ErrIdleTimeout", got, err)
+	}
+}
+
+func TestContextCancelsTransfer(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	c := newTestClient(t, srv, "s3cret")
+	_, _, sess, err := c.RegisterDownload("abc", "file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim := ratelimit.New(1, 1)
+	lim.Reserve(1)
+	sess.SetLimiters(lim)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sess.SendFileContext(ctx, bytes.NewReader([]byte("slow")), 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SendFileContext: %v, want deadline exceeded", err)
+	}
+
+	_, _, stream, err := c.RegisterUploadStream("def", "up.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := stream.ReadContext(ctx, make([]byte, 10)); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadContext: %v, want canceled", err)
+	}
+}
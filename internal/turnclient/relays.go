@@ -0,0 +1,153 @@
+package turnclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Selection is how a Client with several relays picks one for a new session. Either way, relays
+// that failed last time are tried only after the others.
+type Selection string
+
+const (
+	Priority   Selection = "priority"    // the first working relay in the list
+	RoundRobin Selection = "round-robin" // working relays in turn, spreading sessions
+)
+
+// ParseSelection returns the Selection named s; "" is Priority.
+func ParseSelection(s string) (Selection, error) {
+	switch Selection(s) {
+	case "", Priority:
+		return Priority, nil
+	case RoundRobin:
+		return RoundRobin, nil
+	}
+	return "", fmt.Errorf("unknown relay selection %q (want %s or %s)", s, Priority, RoundRobin)
+}
+
+// relay is one relay a Client can register sessions on.
+type relay struct {
+	url       string
+	host      string
+	port      int
+	tlsConfig *tls.Config
+
+	// Guarded by Client.mu.
+	down    bool
+	err     error
+	checked time.Time
+}
+
+// parseRelay parses a turns:// URL (default port 5349). A tlsConfig without ServerName is copied
+// and given the relay host.
+func parseRelay(turnURL string, tlsConfig *tls.Config) (*relay, error) {
+	u, err := url.Parse(turnURL)
+	if err != nil {
+		return nil, err
+	}
+	port := 5349
+	if u.Port() != "" {
+		port, _ = strconv.Atoi(u.Port())
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("missing host in %s", turnURL)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	} else if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	return &relay{url: turnURL, host: host, port: port, tlsConfig: tlsConfig}, nil
+}
+
+func (r *relay) dialTLS(ctx context.Context) (*tls.Conn, error) {
+	addr := net.JoinHostPort(r.host, strconv.Itoa(r.port))
+	var d net.Dialer
+	tcpConn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(tcpConn, r.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// candidates returns the relays in the order a new session tries them.
+func (c *Client) candidates() []*relay {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := 0
+	if c.Selection == RoundRobin {
+		start = c.next
+		c.next = (c.next + 1) % len(c.relays)
+	}
+	order := make([]*relay, 0, len(c.relays))
+	for i := range c.relays {
+		order = append(order, c.relays[(start+i)%len(c.relays)])
+	}
+	sort.SliceStable(order, func(i, j int) bool { return !order[i].down && order[j].down })
+	return order
+}
+
+// mark records whether using r just worked.
+func (c *Client) mark(r *relay, err error) {
+	c.mu.Lock()
+	r.down, r.err, r.checked = err != nil, err, time.Now()
+	c.mu.Unlock()
+}
+
+// Health is what a Client last saw of one relay.
+type Health struct {
+	URL     string
+	Healthy bool
+	Err     error     // why it is not healthy
+	Checked time.Time // zero until the relay is first used or checked
+}
+
+// Health returns the state of each relay, in configuration order.
+func (c *Client) Health() []Health {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := make([]Health, len(c.relays))
+	for i, r := range c.relays {
+		h[i] = Health{URL: r.url, Healthy: !r.down, Err: r.err, Checked: r.checked}
+	}
+	return h
+}
+
+// CheckHealth connects to every relay at once (handshake, protocol negotiation and auth, each
+// bounded by DialTimeout), records which work and returns Health. Sessions prefer relays that
+// passed, so call it periodically to find out when a failed relay is back before a user has to
+// wait for it.
+func (c *Client) CheckHealth(ctx context.Context) []Health {
+	var wg sync.WaitGroup
+	for _, r := range c.relays {
+		wg.Add(1)
+		go func(r *relay) {
+			defer wg.Done()
+			dialCtx, cancel := c.dialContext(ctx)
+			defer cancel()
+			conn, _, err := c.connect(dialCtx, r)
+			if err == nil {
+				conn.Close()
+			}
+			if ctx.Err() == nil {
+				c.mark(r, err)
+			}
+		}(r)
+	}
+	wg.Wait()
+	return c.Health()
+}
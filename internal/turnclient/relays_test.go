@@ -0,0 +1,125 @@
+package turnclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/awgh/huzaa-bot/internal/relaytest"
+)
+
+// deadRelayURL returns a relay URL nothing listens on.
+func deadRelayURL(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return "turns://" + addr
+}
+
+// newFailoverClient returns a client for urls. Each test relay has its own self-signed
+// certificate, so verification is off.
+func newFailoverClient(t *testing.T, urls ...string) *Client {
+	t.Helper()
+	c, err := NewFailoverClient(urls, &tls.Config{InsecureSkipVerify: true}, "bot", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFailover(t *testing.T) {
+	srv := newRelay(t, &relaytest.Config{})
+	dead := deadRelayURL(t)
+	c := newFailoverClient(t, dead, srv.URL())
+
+	for i := 0; i < 2; i++ {
+		_, _, sess, err := c.RegisterDownload("abc", "f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess.Close()
+	}
+	if n := len(srv.Registrations()); n != 2 {
+		t.Errorf("%d registrations on the working relay, want 2", n)
+	}
+	h := c.Health()
+	if h[0].URL != dead || h[0].Healthy || h[0].Err == nil || !h[1].Healthy {
+		t.Errorf("health %+v", h)
+	}
+
+	// With the working relay down too, the error says so.
+	srv.Close()
+	_, _, _, err := c.RegisterUploadStream("abc", "f")
+	if err == nil || !strings.Contains(err.Error(), "all 2 relays failed") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestFailoverRelayError(t *testing.T) {
+	busy := newRelay(t, &relaytest.Config{RejectRegister: "too many sessions"})
+	c := newFailoverClient(t, busy.URL())
+	_, _, _, err := c.RegisterDownload("abc", "f")
+	var relayErr RelayError
+	if !errors.As(err, &relayErr) || string(relayErr) != "too many sessions" {
+		t.Fatalf("err = %v", err)
+	}
+	// The relay answered, so it is not marked down.
+	if h := c.Health(); !h[0].Healthy {
+		t.Errorf("health %+v", h)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	a := newRelay(t, &relaytest.Config{})
+	b := newRelay(t, &relaytest.Config{})
+	c := newFailoverClient(t, a.URL(), b.URL())
+	c.Selection = RoundRobin
+	for i := 0; i < 4; i++ {
+		_, _, stream, err := c.RegisterUploadStream("abc", "f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Close()
+	}
+	if na, nb := len(a.Registrations()), len(b.Registrations()); na != 2 || nb != 2 {
+		t.Errorf("registrations %d and %d, want 2 each", na, nb)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	a := newRelay(t, &relaytest.Config{})
+	b := newRelay(t, &relaytest.Config{})
+	c := newFailoverClient(t, a.URL(), b.URL())
+	a.Close()
+	h := c.CheckHealth(context.Background())
+	if h[0].Healthy || !h[1].Healthy || h[1].Checked.IsZero() {
+		t.Errorf("health %+v", h)
+	}
+	// The relay that failed the check is tried last, even with priority selection.
+	if _, _, sess, err := c.RegisterDownload("abc", "f"); err != nil {
+		t.Fatal(err)
+	} else {
+		sess.Close()
+	}
+	if n := len(b.Registrations()); n != 1 {
+		t.Errorf("%d registrations on the healthy relay", n)
+	}
+}
+
+func TestParseSelection(t *testing.T) {
+	for in, want := range map[string]Selection{"": Priority, "priority": Priority, "round-robin": RoundRobin} {
+		if got, err := ParseSelection(in); got != want || err != nil {
+			t.Errorf("ParseSelection(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := ParseSelection("random"); err == nil {
+		t.Error("accepted an unknown selection")
+	}
+}